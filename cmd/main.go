@@ -15,174 +15,406 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"strings"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
 
+	"os-climate.org/carbon-intensity/pkg/checkpoint"
+	"os-climate.org/carbon-intensity/pkg/config"
 	"os-climate.org/carbon-intensity/pkg/data_publisher"
 	"os-climate.org/carbon-intensity/pkg/data_source"
 	"os-climate.org/carbon-intensity/pkg/reader"
-	"os-climate.org/carbon-intensity/pkg/utils"
+	"os-climate.org/carbon-intensity/pkg/zones"
 
 	"github.com/jessevdk/go-flags"
 )
 
 // App configuration details loaded from config file at boot.
 var globalConfig struct {
-	zones         []string
-	dryRun        bool
-	dataSource    string
-	reader        string
-	dataPublisher string
+	zones          []string
+	dryRun         bool
+	dataSource     string
+	reader         string
+	dataPublishers []string
 }
 
+// Exit status codes. A process stopped by a signal exits with 128 + the signal number.
+const (
+	exitOK           = 0
+	exitReaderError  = 1 // The reader could not retrieve the data.
+	exitPublishError = 2 // One or more readings were not delivered by the publisher.
+	exitConfigError  = 3 // The configuration is invalid.
+)
+
+// Configuration items that choose the components the service is built from.
+const (
+	dataSourceConfigItem    = "data-source"
+	readerConfigItem        = "reader"
+	dataPublisherConfigItem = "data-publisher"
+)
+
+// Command-line options. Any configuration item can be overridden with --set; the most common have their own option.
+type commandLineOptions struct {
+	DryRun        bool     `long:"dry-run" description:"Dry run - send output to console instead of the configured data publisher."`
+	ConfigFile    string   `long:"config" value-name:"FILE" description:"Application configuration file, in properties or YAML (.yaml, .yml) format. Defaults to ./config/app-config.properties"`
+	Set           []string `long:"set" value-name:"NAME=VALUE" description:"Override a configuration item. Can be repeated."`
+	DataSource    string   `long:"data-source" description:"Override the data-source configuration item."`
+	Reader        string   `long:"reader" description:"Override the reader configuration item."`
+	DataPublisher string   `long:"data-publisher" description:"Override the data-publisher configuration item. A comma-separated list delivers to each publisher."`
+}
+
+// The number of delivery reports that can be waiting to be processed.
+const deliveryReportBuffer = 100
+
+// How long the reader has to stop after a signal is received. It is shorter than the default Kubernetes
+// termination grace period (30s) so the publisher can still be flushed before the pod is killed.
+const shutdownGracePeriod = 20 * time.Second
+
 // Map that contains all of the possible publisher. A configuration determines which wil lbe instantiated.
 var publisherMap = map[string]data_publisher.IDataPublisher{
 	"console-publisher": &data_publisher.ConsolePublisher{},
-	"kafka-publisher":   &data_publisher.KafkaPublisher{}}
+	"kafka-publisher":   &data_publisher.KafkaPublisher{},
+	"file-publisher":    &data_publisher.FilePublisher{},
+	"parquet-publisher": &data_publisher.ParquetPublisher{},
+	"webhook-publisher": &data_publisher.WebhookPublisher{},
+	"mqtt-publisher":    &data_publisher.MQTTPublisher{},
+	"nats-publisher":    &data_publisher.NATSPublisher{}}
 
 // Map that contains all of the possible data sources. A configuration determines which wil lbe instantiated.
 var readerMap = map[string]reader.IReader{
-	//	"time-reader": &reader.TimerReader{},
-	"one-shot": &reader.OneShotReader{}}
+	"time-reader": &reader.TimerReader{},
+	"one-shot":    &reader.OneShotReader{}}
 
 // Map that contains all of the possible data sources. A configuration determines which wil lbe instantiated.
 var providerMap = map[string]data_source.IDataSource{
-	// "simulator": &data_source.Simulator{},
-	"co2-signal": &data_source.CO2SignalDataProvider{}}
+	"simulator":           &data_source.Simulator{},
+	"co2-signal":          &data_source.CO2SignalDataProvider{},
+	"electricity-maps":    &data_source.ElectricityMapsDataProvider{},
+	"uk-carbon-intensity": &data_source.UKCarbonIntensityDataProvider{},
+	"watttime":            &data_source.WattTimeDataProvider{},
+	"entsoe":              &data_source.EntsoeDataProvider{},
+	"eia":                 &data_source.EIADataProvider{}}
 
 func init() {
 	log.Println("Initialising...")
 
-	parseCommandLineArgs()
+	opts := parseCommandLineArgs()
+
+	// Load and validate the configuration before anything is started, so every problem is reported at once.
+	appConfig, err := loadConfig(opts)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		os.Exit(exitConfigError)
+	}
+	config.SetApp(appConfig)
+	log.Printf("Loaded config:\n%s", appConfig.Summary())
 
-	// Load the configuration data from the configuration file
-	// TODO: Add check to make sure the configuraiton item is valid
-	config := utils.ReadConfig("./config/app-config.properties")
-	globalConfig.dataSource = config["data-source"] // Which data source will the service use?
-	globalConfig.reader = config["reader"]
-	globalConfig.dataPublisher = config["data-publisher"] // Which publisher will the service use?
+	globalConfig.dataSource = appConfig.String(dataSourceConfigItem) // Which data source will the service use?
+	globalConfig.reader = appConfig.String(readerConfigItem)
+	globalConfig.dataPublishers = appConfig.List(dataPublisherConfigItem) // Which publishers will the service use?
+}
 
-	if globalConfig.dryRun {
-		// Override the configuration file if the command line switch is --dry-run
+// loadConfig registers the configuration items of every component, then layers the values from the
+// configuration file, the environment and the command line. The components that can be chosen are the ones
+// registered in the publisher, reader and provider maps. Returns an error listing every problem found.
+func loadConfig(opts commandLineOptions) (*config.Config, error) {
+	appConfig := config.New()
+	appConfig.Register(
+		config.Item{Key: dataSourceConfigItem, Kind: config.KindString, Required: true, Options: mapKeys(providerMap)},
+		config.Item{Key: readerConfigItem, Kind: config.KindString, Required: true, Options: mapKeys(readerMap)},
+		config.Item{Key: dataPublisherConfigItem, Kind: config.KindList, Required: true, Options: mapKeys(publisherMap),
+			Check: noDuplicates})
+	appConfig.Register(data_source.ConfigItems()...)
+	appConfig.Register(reader.ConfigItems()...)
+	appConfig.Register(checkpoint.ConfigItems()...)
+	appConfig.Register(zones.ConfigItems()...)
+	appConfig.Register(data_publisher.ConfigItems()...)
+
+	// The default file is optional so the service can be configured from the environment alone.
+	configFile := opts.ConfigFile
+	if configFile == "" {
+		configFile = config.DefaultFile
+	}
+	if err := appConfig.LoadFile(configFile); err != nil {
+		if opts.ConfigFile != "" || !os.IsNotExist(err) {
+			return nil, err
+		}
+		log.Printf("WARNING: %v. Using the environment and command line only.", err)
+	}
+
+	appConfig.LoadEnv(config.EnvPrefix)
+
+	var errs config.Errors
+	for _, pair := range opts.Set {
+		if err := appConfig.SetOverride(pair); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	overrides := map[string]string{
+		dataSourceConfigItem:    opts.DataSource,
+		readerConfigItem:        opts.Reader,
+		dataPublisherConfigItem: opts.DataPublisher,
+	}
+	for key, value := range overrides {
+		if value != "" {
+			appConfig.Set(key, value, config.SourceCommandLine)
+		}
+	}
+
+	if opts.DryRun {
+		// Override the configuration if the command line switch is --dry-run
 		log.Println("Running with --dry-run")
-		globalConfig.dataPublisher = "console-publisher"
+		appConfig.Set(dataPublisherConfigItem, "console-publisher", "--dry-run")
 	}
 
-	log.Printf("Loaded config: %v\n", globalConfig)
+	if err := appConfig.Validate(); err != nil {
+		errs = append(errs, err.(config.Errors)...)
+	}
+
+	return appConfig, errs.OrNil()
+}
+
+// mapKeys returns the sorted keys of a map, which are the options for the component it holds.
+func mapKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// noDuplicates returns an error if a value appears more than once in a list.
+func noDuplicates(value string) error {
+	seen := make(map[string]bool)
+	for _, v := range config.SplitList(value) {
+		if seen[v] {
+			return fmt.Errorf("%s is listed more than once", v)
+		}
+		seen[v] = true
+	}
+
+	return nil
 }
 
 func main() {
-	// Create a function thaty will be called on program exit so you cam close file handles etc.
-	defer func() {
-		cleanup()
-	}()
+	os.Exit(run())
+}
 
+// run starts the reader and publishes its readings until the reader finishes or a signal is received.
+// It returns the status code the process should exit with. It is separate from main so its deferred
+// functions run before the process exits.
+func run() int {
 	// Set up a channel for handling Ctrl-C, etc
 	sigchan := make(chan os.Signal, 1)
-	c := make(chan string) // Channel for passing pricing information
-	quit := make(chan int) // Channel for sending quit signals.
-	defer close(sigchan)
-	defer close(c)
-	defer close(quit)
-
-	provider, exists := providerMap[globalConfig.dataSource]
-	if !exists {
-		optionList := ""
-		for k := range providerMap {
-			optionList += k + " "
-		}
-		var err error = fmt.Errorf("specified data source (%s) does not exist. Cannot instantiate the publisher. Options are: %s", globalConfig.dataSource, optionList)
-		log.Fatal(err)
-	}
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+
+	// Cancelling the context abandons any request to the data source that is in progress so a hung
+	// upstream cannot stall the shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The channels are not closed on exit because the reader may still be running if it failed to stop in time.
+	c := make(chan reader.Reading) // Channel for passing readings from the reader
+	done := make(chan error)       // Channel the reader uses to signal it has finished, or why it stopped.
+	quit := make(chan int)         // Channel for sending quit signals. It is closed so the signal is seen by every receive.
+
+	// Load the checkpoints so readings that were published before a restart are not published again, and the
+	// daily quota of the data source is shared by every run.
+	checkpoints := &checkpoint.FileCheckpointStore{}
+	checkpoints.Initialise()
+	data_source.SetQuotaStore(checkpoints)
+
+	// The configuration has been validated, so the components it names exist.
+	provider := providerMap[globalConfig.dataSource]
 	provider.Initialise()
 
+	// Load the zone details so each reading can be labelled with its country and zone names.
+	registry := &zones.Registry{}
+	registry.Initialise()
+	provider.SetZoneRegistry(registry)
+
 	// Instantiate and initialise the Reader(s)
-	// TODO: Add error handling
-	reader, exists := readerMap[globalConfig.reader] // &reader.TimerReader{}
-	if !exists {
-		optionList := ""
-		for k := range readerMap {
-			optionList += k + " "
-		}
-		var err error = fmt.Errorf("specified reader (%s) does not exist. Cannot instantiate the  reader. Options are: %s", globalConfig.reader, optionList)
-		log.Fatal(err)
-	}
+	reader := readerMap[globalConfig.reader] // &reader.TimerReader{}
 
-	reader.Initialise(c, quit)
+	reader.Initialise(c, done, quit)
 	reader.SetDataProvider(provider)
+	reader.SetCheckpointStore(checkpoints)
 
 	// Instantiate and initialise the Publisher fro the global configuration data
-	publisher, exists := publisherMap[globalConfig.dataPublisher]
-	if !exists {
-		optionList := ""
-		for k := range publisherMap {
-			optionList += k + " "
+	publisher := newPublisher(globalConfig.dataPublishers)
+	publisher.Initialise()
+
+	// Record a checkpoint for each reading the publisher delivers. Reports are handled on their own goroutine
+	// so the publisher can always make progress, even while this goroutine is blocked publishing.
+	reports := make(chan data_publisher.DeliveryReport, deliveryReportBuffer)
+	failures := make(chan int)
+	publisher.SetDeliveryChannel(reports)
+	go handleDeliveryReports(reports, checkpoints, failures)
+
+	// Flush and close the publisher. Once it has been cleaned up no more reports will be sent, so the checkpoints
+	// can be closed. Returns the number of readings that were not delivered.
+	shutdown := func() int {
+		cleanup(publisher)
+		close(reports)
+		failed := <-failures
+		if err := checkpoints.Close(); err != nil {
+			log.Printf("ERROR: Failed to save the checkpoints: %v", err)
 		}
-		var err error = fmt.Errorf("specified  publisher (%s) does not exist. Cannot instantiate the publisher. Options are: %s", globalConfig.dataPublisher, optionList)
-		log.Fatal(err)
+		return failed
 	}
-	publisher.Initialise()
+
+	// Work out which zones this deployment reads.
+	selector := &zones.Selector{}
+	selector.Initialise()
+	selector.SetZoneRegistry(registry)
 
 	// Start the reader thread
-	globalConfig.zones = provider.GetAvailableZones()
-	go reader.GetCarbonIntensity(globalConfig.zones)
+	var err error
+	globalConfig.zones, err = selector.SelectZones(ctx, provider)
+	if err != nil {
+		log.Printf("ERROR: Failed to select the zones: %v", err)
+		shutdown()
+		return exitReaderError
+	}
+	go reader.GetCarbonIntensity(ctx, globalConfig.zones)
 
-	// Process messages
-	run := true
+	// Process messages until the reader is done. When a signal is received the reader is told to stop, and
+	// any readings it sends while stopping are still published.
+	exitCode := exitOK
+	publishFailures := 0
+	var shutdownTimeout <-chan time.Time
 loop:
-	for run {
+	for {
 		select {
 		case sig := <-sigchan:
-			log.Printf("Caught signal %v: terminating\n", sig)
-			run = false
-		default:
-			m := <-c         // Test the channel to see if the price getter has retrieved a quote
-			if m == "done" { // Check if the reader is done.
-				break loop
-			} else if m != "" {
-				SendToPublisher(publisher, m)
+			log.Printf("Caught signal %v: shutting down\n", sig)
+			exitCode = signalExitCode(sig)
+
+			// Restore the default behaviour so a second signal terminates immediately.
+			signal.Stop(sigchan)
+			sigchan = nil
+
+			cancel()
+			close(quit)
+			shutdownTimeout = time.After(shutdownGracePeriod)
+		case m := <-c: // The reader has retrieved a reading
+			if err := SendToPublisher(publisher, m); err != nil {
+				log.Printf("ERROR: Failed to publish reading for zone %s: %v", m.Zone, err)
+				publishFailures++
 			}
+		case err := <-done: // Check if the reader is done.
+			if err != nil {
+				log.Printf("ERROR: Reader stopped: %v", err)
+				if exitCode == exitOK {
+					exitCode = exitReaderError
+				}
+			}
+			break loop
+		case <-shutdownTimeout:
+			log.Printf("ERROR: Reader did not stop within %v", shutdownGracePeriod)
+			break loop
+		}
+	}
+
+	if n := publishFailures + shutdown(); n > 0 {
+		log.Printf("ERROR: %d readings were not delivered", n)
+		if exitCode == exitOK {
+			exitCode = exitPublishError
 		}
 	}
 
-	log.Printf("Exiting")
+	log.Printf("Exiting with status %d", exitCode)
+	return exitCode
 }
 
-// Send the key/value to the instantiated Data Publisher
-func SendToPublisher(publisher data_publisher.IDataPublisher, priceData string) {
-	arr := strings.SplitN(priceData, ",", 2)
+// newPublisher returns the publisher with the name, or a CompositePublisher that delivers to each of the publishers
+// if there is more than one.
+func newPublisher(names []string) data_publisher.IDataPublisher {
+	if len(names) == 1 {
+		return publisherMap[names[0]]
+	}
 
-	// Check the data is formatted properly
-	if len(arr) == 2 {
-		publisher.PublishData(arr[0], arr[1])
-	} else {
-		log.Printf("ERROR: Badly formatted data in SendToPublisher. No comma separater: %s", priceData)
+	composite := &data_publisher.CompositePublisher{}
+	for _, name := range names {
+		composite.AddPublisher(name, publisherMap[name])
 	}
 
+	return composite
 }
 
-// Called on program exit. Place any cleanup functions here
-func cleanup() {
+// Send the reading to the instantiated Data Publisher. The reading is passed through to its delivery report.
+func SendToPublisher(publisher data_publisher.IDataPublisher, reading reader.Reading) error {
+	if reading.Key == "" {
+		return fmt.Errorf("reading from %s has no key", reading.Source)
+	}
 
+	return publisher.PublishData(reading.Key, reading.Payload, reading)
 }
 
-// isDryRun check is there is an os arg of "--dry-run". If there is then it returns tru. If not then it returns false.
-func parseCommandLineArgs() {
-	var opts struct {
-		// Slice of bool will append 'true' each time the option
-		// is encountered (can be set multiple times, like -vvv)
-		DryRun bool `long:"dry-run" description:"Dry run - send output to console instead of the configured data publisher."`
+// handleDeliveryReports records a checkpoint for every reading that was delivered, so it is not published again.
+// A reading that was not delivered is not checkpointed, so it is published again the next time its zone is read.
+// When the reports channel is closed it sends the number of failed deliveries on failures.
+func handleDeliveryReports(reports chan data_publisher.DeliveryReport, checkpoints checkpoint.ICheckpointStore, failures chan int) {
+	failed := 0
+	for r := range reports {
+		reading, ok := r.Opaque.(reader.Reading)
+		if !ok {
+			log.Printf("ERROR: Delivery report for %s is not for a reading", r.Key)
+			continue
+		}
+
+		if r.Err != nil {
+			log.Printf("ERROR: Reading for zone %s at %s was not delivered: %v", reading.Zone, reading.Datetime, r.Err)
+			failed++
+			continue
+		}
+
+		if err := checkpoints.RecordPublished(reading.Key, reading.Datetime); err != nil {
+			log.Printf("WARNING: Failed to record published checkpoint for %s: %v", reading.Key, err)
+		}
 	}
 
+	failures <- failed
+}
+
+// Called on program exit. Place any cleanup functions here
+func cleanup(publisher data_publisher.IDataPublisher) {
+	log.Println("Cleaning up the publisher")
+	publisher.Cleanup()
+}
+
+// signalExitCode returns the conventional exit status for a process stopped by a signal: 128 + the signal number.
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+
+	return exitReaderError
+}
+
+// parseCommandLineArgs parses the command-line options. It exits if they are invalid or --help is given.
+func parseCommandLineArgs() commandLineOptions {
+	var opts commandLineOptions
+
 	_, err := flags.Parse(&opts)
 	if err != nil {
+		if flags.WroteHelp(err) {
+			os.Exit(exitOK)
+		}
 		log.Println("Invalid command-line options. Use --help for details.")
-		os.Exit(1)
+		os.Exit(exitConfigError)
 	}
 
 	log.Printf("Dry run: %v\n", opts.DryRun)
 
 	globalConfig.dryRun = opts.DryRun
+	return opts
 }
@@ -0,0 +1,22 @@
+-- External table over the files written by the parquet-publisher. Replace the location with parquet-publisher-dir,
+-- or the object store the files are copied to. The columns match config/co2signal-trino-schema.json.
+CREATE TABLE hive.electricitymap.co2signal_parquet (
+    country_name VARCHAR,
+    zone_name VARCHAR,
+    status VARCHAR,
+    datetime TIMESTAMP,
+    carbon_intensity DOUBLE,
+    fossel_fuel_percentage DOUBLE,
+    unit_name VARCHAR,
+    unit_value VARCHAR,
+    country_code VARCHAR,
+    date VARCHAR
+)
+WITH (
+    external_location = 's3a://carbon-intensity/parquet/',
+    format = 'PARQUET',
+    partitioned_by = ARRAY['country_code', 'date']
+);
+
+-- Register the partitions that have been written since the last call.
+CALL hive.system.sync_partition_metadata('electricitymap', 'co2signal_parquet', 'ADD');
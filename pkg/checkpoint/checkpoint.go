@@ -0,0 +1,53 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package checkpoint records how far each zone has been read so the service can resume after a restart
+// without publishing the same reading twice.
+package checkpoint
+
+import "time"
+
+// Checkpoint is the progress recorded for a single zone.
+type Checkpoint struct {
+	Datetime  string    `json:"datetime"`   // The datetime of the last reading that was successfully published.
+	FetchTime time.Time `json:"fetch_time"` // The time the zone was last fetched successfully from the data source.
+}
+
+// QuotaUsage is the number of requests a data source has made on a UTC day, so a daily quota holds across runs.
+type QuotaUsage struct {
+	Day  string `json:"day"` // e.g. 2022-10-17.
+	Used int    `json:"used"`
+}
+
+// ICheckpointStore defines the interface that all checkpoint stores should implement.
+type ICheckpointStore interface {
+	// Initialise loads any previously persisted checkpoints and must be the first method called.
+	Initialise()
+
+	// Get returns the checkpoint for a zone and whether one exists.
+	Get(zone string) (Checkpoint, bool)
+
+	// HasAdvanced returns true if the datetime is later than the last published datetime for the zone.
+	HasAdvanced(zone string, datetime string) bool
+
+	// RecordFetch records the time a zone was fetched successfully from the data source.
+	RecordFetch(zone string, fetchTime time.Time) error
+
+	// RecordPublished records the datetime of the last reading published for a zone. It never moves a zone's
+	// checkpoint back to an earlier datetime.
+	RecordPublished(zone string, datetime string) error
+
+	// Close persists any checkpoints that have not been persisted yet. It is called once, on exit.
+	Close() error
+}
@@ -0,0 +1,254 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checkpoint
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// Configuration items for the checkpoint store.
+const (
+	checkpointFileConfigItem          = "checkpoint-file"           // Path of the checkpoint file.
+	checkpointFlushIntervalConfigItem = "checkpoint-flush-interval" // Seconds between writes of the checkpoint file.
+)
+
+// Flush interval, in seconds, used if the configuration file does not specify one.
+const defaultCheckpointFlushInterval = "30"
+
+// ConfigItems returns the configuration items used by the checkpoint store.
+func ConfigItems() []config.Item {
+	return []config.Item{
+		{Key: checkpointFileConfigItem, Kind: config.KindString},
+		{Key: checkpointFlushIntervalConfigItem, Kind: config.KindInt, Default: defaultCheckpointFlushInterval,
+			Check: config.AtLeast(0)},
+	}
+}
+
+// FileCheckpointStore is an implementation of the ICheckpointStore that persists the checkpoints as a JSON file.
+// Changes are batched: the file is written at most once every flush interval, and when the store is closed.
+// If no file is configured the checkpoints are only held in memory and are lost when the service exits.
+type FileCheckpointStore struct {
+	path          string
+	flushInterval time.Duration
+	mutex         sync.Mutex
+	checkpoints   map[string]Checkpoint
+	quotaUsage    map[string]QuotaUsage // By data source.
+	dirty         bool                  // The checkpoints have changed since they were last written.
+	lastSave      time.Time             // When the checkpoints were last written.
+}
+
+// checkpointFile is the layout of the checkpoint file. Files written before the quota usage was recorded hold just
+// the zones, and are still read.
+type checkpointFile struct {
+	Zones      map[string]Checkpoint `json:"zones"`
+	QuotaUsage map[string]QuotaUsage `json:"quota_usage,omitempty"`
+}
+
+// Initialise reads the checkpoint file location from the configuration file and loads any existing checkpoints.
+func (s *FileCheckpointStore) Initialise() {
+	appConfig := config.App()
+	s.path = appConfig.String(checkpointFileConfigItem)
+	s.flushInterval = time.Duration(appConfig.Int(checkpointFlushIntervalConfigItem)) * time.Second
+	s.checkpoints = make(map[string]Checkpoint)
+	s.quotaUsage = make(map[string]QuotaUsage)
+	s.lastSave = time.Now()
+
+	if s.path == "" {
+		log.Printf("WARNING: %s is not set. Checkpoints will not survive a restart.", checkpointFileConfigItem)
+		return
+	}
+
+	if err := s.load(); err != nil {
+		log.Printf("WARNING: Could not load checkpoints from %s: %v", s.path, err)
+		return
+	}
+	log.Printf("Loaded %d checkpoints from %s", len(s.checkpoints), s.path)
+}
+
+// Get returns the checkpoint for a zone and whether one exists.
+func (s *FileCheckpointStore) Get(zone string) (Checkpoint, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cp, ok := s.checkpoints[zone]
+	return cp, ok
+}
+
+// HasAdvanced returns true if the datetime is later than the last published datetime for the zone.
+// A zone that has never been published has always advanced.
+func (s *FileCheckpointStore) HasAdvanced(zone string, datetime string) bool {
+	cp, ok := s.Get(zone)
+	if !ok || cp.Datetime == "" {
+		return true
+	}
+
+	return isLater(datetime, cp.Datetime)
+}
+
+// RecordFetch records the time a zone was fetched from the data source.
+func (s *FileCheckpointStore) RecordFetch(zone string, fetchTime time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cp := s.checkpoints[zone]
+	cp.FetchTime = fetchTime
+	s.checkpoints[zone] = cp
+
+	return s.changed()
+}
+
+// RecordPublished records the datetime of the last reading published for a zone. Delivery reports can arrive out
+// of order, so the checkpoint only moves forward: a datetime that is not later than the recorded one is ignored.
+func (s *FileCheckpointStore) RecordPublished(zone string, datetime string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cp := s.checkpoints[zone]
+	if cp.Datetime != "" && !isLater(datetime, cp.Datetime) {
+		return nil
+	}
+	cp.Datetime = datetime
+	s.checkpoints[zone] = cp
+
+	return s.changed()
+}
+
+// QuotaUsed returns the number of requests a data source has made on a UTC day, e.g. 2022-10-17.
+func (s *FileCheckpointStore) QuotaUsed(source string, day string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	usage, ok := s.quotaUsage[source]
+	if !ok || usage.Day != day {
+		return 0
+	}
+
+	return usage.Used
+}
+
+// RecordQuotaUsed records the number of requests a data source has made on a UTC day.
+func (s *FileCheckpointStore) RecordQuotaUsed(source string, day string, used int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.quotaUsage[source] = QuotaUsage{Day: day, Used: used}
+
+	return s.changed()
+}
+
+// Close writes any checkpoints that have not been written yet.
+func (s *FileCheckpointStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.dirty {
+		return nil
+	}
+
+	return s.save()
+}
+
+// changed marks the checkpoints as changed and writes them if the flush interval has passed since they were last
+// written. The caller must hold the mutex.
+func (s *FileCheckpointStore) changed() error {
+	s.dirty = true
+	if time.Since(s.lastSave) < s.flushInterval {
+		return nil
+	}
+
+	return s.save()
+}
+
+// load reads the checkpoint file. A missing file is not an error because it will be created on the first save.
+func (s *FileCheckpointStore) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var file checkpointFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	if file.Zones == nil {
+		return json.Unmarshal(data, &s.checkpoints)
+	}
+
+	s.checkpoints = file.Zones
+	if file.QuotaUsage != nil {
+		s.quotaUsage = file.QuotaUsage
+	}
+
+	return nil
+}
+
+// save writes the checkpoints to a temporary file and renames it over the checkpoint file so a crash part
+// way through a write cannot corrupt the existing checkpoints. The caller must hold the mutex.
+func (s *FileCheckpointStore) save() error {
+	if s.path == "" {
+		s.dirty = false
+		return nil
+	}
+
+	data, err := json.MarshalIndent(checkpointFile{Zones: s.checkpoints, QuotaUsage: s.quotaUsage}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once the rename has succeeded.
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	s.lastSave = time.Now()
+
+	return nil
+}
+
+// isLater compares two reading datetimes. The data providers return RFC 3339 timestamps, but if either cannot be
+// parsed the strings are compared directly, which still orders correctly for a consistent ISO 8601 format.
+func isLater(datetime string, previous string) bool {
+	t1, err1 := time.Parse(time.RFC3339, datetime)
+	t2, err2 := time.Parse(time.RFC3339, previous)
+	if err1 != nil || err2 != nil {
+		return datetime > previous
+	}
+
+	return t1.After(t2)
+}
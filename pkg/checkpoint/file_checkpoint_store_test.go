@@ -0,0 +1,198 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// openStore initialises a store from the checkpoint file, as the service does on start.
+func openStore(t *testing.T, path string, flushInterval string) *FileCheckpointStore {
+	t.Helper()
+
+	c := config.New()
+	c.Register(ConfigItems()...)
+	c.Set(checkpointFileConfigItem, path, "test")
+	c.Set(checkpointFlushIntervalConfigItem, flushInterval, "test")
+	config.SetApp(c)
+	t.Cleanup(func() { config.SetApp(config.New()) })
+
+	store := &FileCheckpointStore{}
+	store.Initialise()
+
+	return store
+}
+
+func TestFileCheckpointStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	fetchTime := time.Date(2022, 10, 17, 11, 5, 0, 0, time.UTC)
+
+	store := openStore(t, path, "3600")
+	if err := store.RecordFetch("DE", fetchTime); err != nil {
+		t.Fatalf("RecordFetch() error = %v", err)
+	}
+	if err := store.RecordPublished("DE", "2022-10-17T11:00:00.000Z"); err != nil {
+		t.Fatalf("RecordPublished() error = %v", err)
+	}
+
+	// The changes are batched until the flush interval has passed, or the store is closed.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("checkpoint file written before the flush interval: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	reloaded := openStore(t, path, "3600")
+	cp, ok := reloaded.Get("DE")
+	if !ok {
+		t.Fatal("no checkpoint for DE after reloading")
+	}
+	if cp.Datetime != "2022-10-17T11:00:00.000Z" || !cp.FetchTime.Equal(fetchTime) {
+		t.Errorf("Get(DE) = %+v", cp)
+	}
+	if reloaded.HasAdvanced("DE", "2022-10-17T11:00:00.000Z") {
+		t.Error("HasAdvanced() = true for the published datetime after reloading")
+	}
+	if _, ok := reloaded.Get("FR"); ok {
+		t.Error("Get(FR) found a checkpoint that was never recorded")
+	}
+}
+
+func TestFileCheckpointStoreFlushInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+
+	// With a flush interval of 0 every change is written immediately.
+	store := openStore(t, path, "0")
+	if err := store.RecordPublished("DE", "2022-10-17T11:00:00.000Z"); err != nil {
+		t.Fatalf("RecordPublished() error = %v", err)
+	}
+
+	if cp, ok := openStore(t, path, "0").Get("DE"); !ok || cp.Datetime != "2022-10-17T11:00:00.000Z" {
+		t.Errorf("Get(DE) = %+v, %v after reloading without closing", cp, ok)
+	}
+}
+
+func TestFileCheckpointStoreRecordPublished(t *testing.T) {
+	tests := []struct {
+		name      string
+		published []string
+		want      string
+	}{
+		{name: "in order", published: []string{"2022-10-17T10:00:00.000Z", "2022-10-17T11:00:00.000Z"}, want: "2022-10-17T11:00:00.000Z"},
+		{name: "out of order", published: []string{"2022-10-17T11:00:00.000Z", "2022-10-17T10:00:00.000Z"}, want: "2022-10-17T11:00:00.000Z"},
+		{name: "repeated", published: []string{"2022-10-17T11:00:00.000Z", "2022-10-17T11:00:00.000Z"}, want: "2022-10-17T11:00:00.000Z"},
+		{
+			// The same time in another offset is not later.
+			name: "other offset", published: []string{"2022-10-17T11:00:00.000Z", "2022-10-17T12:00:00.000+01:00"},
+			want: "2022-10-17T11:00:00.000Z",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := openStore(t, "", "0")
+			for _, datetime := range tt.published {
+				if err := store.RecordPublished("DE", datetime); err != nil {
+					t.Fatalf("RecordPublished(%s) error = %v", datetime, err)
+				}
+			}
+
+			if cp, _ := store.Get("DE"); cp.Datetime != tt.want {
+				t.Errorf("datetime = %s, want %s", cp.Datetime, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileCheckpointStoreHasAdvanced(t *testing.T) {
+	store := openStore(t, "", "0")
+	if err := store.RecordPublished("DE", "2022-10-17T11:00:00.000Z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RecordFetch("FR", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		zone     string
+		datetime string
+		want     bool
+	}{
+		{zone: "GB", datetime: "2022-10-17T09:00:00.000Z", want: true}, // Unknown zone.
+		{zone: "FR", datetime: "2022-10-17T09:00:00.000Z", want: true}, // Fetched but never published.
+		{zone: "DE", datetime: "2022-10-17T12:00:00.000Z", want: true},
+		{zone: "DE", datetime: "2022-10-17T11:00:00.000Z", want: false},
+		{zone: "DE", datetime: "2022-10-17T10:00:00.000Z", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := store.HasAdvanced(tt.zone, tt.datetime); got != tt.want {
+			t.Errorf("HasAdvanced(%s, %s) = %v, want %v", tt.zone, tt.datetime, got, tt.want)
+		}
+	}
+}
+
+func TestFileCheckpointStoreQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+
+	store := openStore(t, path, "3600")
+	if err := store.RecordQuotaUsed("entsoe", "2022-10-17", 42); err != nil {
+		t.Fatalf("RecordQuotaUsed() error = %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	reloaded := openStore(t, path, "3600")
+	tests := []struct {
+		source string
+		day    string
+		want   int
+	}{
+		{source: "entsoe", day: "2022-10-17", want: 42},
+		{source: "entsoe", day: "2022-10-18", want: 0}, // The quota resets each day.
+		{source: "eia", day: "2022-10-17", want: 0},
+	}
+	for _, tt := range tests {
+		if got := reloaded.QuotaUsed(tt.source, tt.day); got != tt.want {
+			t.Errorf("QuotaUsed(%s, %s) = %d, want %d", tt.source, tt.day, got, tt.want)
+		}
+	}
+}
+
+// TestFileCheckpointStoreLegacyFile checks that a file written before the quota usage was recorded, which holds
+// just the zones, is still read.
+func TestFileCheckpointStoreLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints.json")
+	legacy := `{"DE": {"datetime": "2022-10-17T11:00:00.000Z", "fetch_time": "2022-10-17T11:05:00Z"}}`
+	if err := ioutil.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := openStore(t, path, "0")
+	if cp, ok := store.Get("DE"); !ok || cp.Datetime != "2022-10-17T11:00:00.000Z" {
+		t.Errorf("Get(DE) = %+v, %v", cp, ok)
+	}
+	if got := store.QuotaUsed("entsoe", "2022-10-17"); got != 0 {
+		t.Errorf("QuotaUsed() = %d, want 0", got)
+	}
+}
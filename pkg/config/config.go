@@ -0,0 +1,330 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config loads and validates the application configuration. Each package describes the configuration
+// items it uses, and the values are layered from a properties or YAML file, environment variables and the
+// command line. Every problem is reported at once so a deployment can be fixed in one pass.
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultFile is the location of the application configuration file if the command line does not set one.
+const DefaultFile = "./config/app-config.properties"
+
+// EnvPrefix is the prefix of environment variables that set a configuration item. The rest of the name is
+// lower-cased and underscores become hyphens, e.g. CARBON_INTENSITY_TIME_READER_INTERVAL sets time-reader-interval.
+const EnvPrefix = "CARBON_INTENSITY_"
+
+// The sources reported for values that were not loaded from a file.
+const (
+	sourceDefault     = "default"
+	sourceEnvironment = "environment"
+	SourceCommandLine = "command line"
+)
+
+// Kind is the type of value a configuration item holds.
+type Kind int
+
+const (
+	KindString Kind = iota
+	KindInt
+	KindFloat
+	KindBool
+	KindList // Comma-separated strings.
+)
+
+// String returns the name of the kind used in validation messages.
+func (k Kind) String() string {
+	switch k {
+	case KindInt:
+		return "an integer"
+	case KindFloat:
+		return "a number"
+	case KindBool:
+		return "true or false"
+	case KindList:
+		return "a comma-separated list"
+	default:
+		return "a string"
+	}
+}
+
+// Condition is a configuration item having a particular value.
+type Condition struct {
+	Key   string
+	Value string
+}
+
+// When returns a Condition that holds when the item has the value, or is a list that contains the value.
+func When(key string, value string) *Condition {
+	return &Condition{Key: key, Value: value}
+}
+
+// Item describes a configuration item so its value can be validated and defaulted.
+type Item struct {
+	Key        string
+	Kind       Kind
+	Default    string                   // Used if the item is not set. Empty means no default.
+	Required   bool                     // The item must be set.
+	RequiredIf *Condition               // The item must be set when the condition holds.
+	Options    []string                 // The values the item may have. Each value of a list must be one. Empty means any value.
+	Check      func(value string) error // Further validation of a value that has been set. Optional.
+	Secret     bool                     // The value is a credential, so it is masked wherever the configuration is logged.
+}
+
+// The masked value that is logged in place of a secret.
+const maskedValue = "********"
+
+// shown returns the value of an item as it may be logged: masked if the item is a secret.
+func (item Item) shown(value string) string {
+	if item.Secret && value != "" {
+		return maskedValue
+	}
+
+	return value
+}
+
+// Config holds the configuration items and their values. Values are set in layers, each replacing the value
+// from the layer before. It is safe to read from many goroutines once it has been loaded.
+type Config struct {
+	mutex    sync.Mutex
+	items    map[string]Item
+	values   map[string]string
+	sources  map[string]string
+	problems Errors // Problems found while loading. They are reported by Validate.
+}
+
+// New creates an empty configuration.
+func New() *Config {
+	return &Config{items: make(map[string]Item), values: make(map[string]string), sources: make(map[string]string)}
+}
+
+var app = New()
+
+// App returns the application configuration. Until SetApp is called it is empty, so every item has its default.
+func App() *Config {
+	return app
+}
+
+// SetApp sets the configuration returned by App. It is called once the configuration has been validated.
+func SetApp(c *Config) {
+	app = c
+}
+
+// Register adds the descriptions of configuration items. An item registered twice keeps the later description.
+func (c *Config) Register(items ...Item) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, item := range items {
+		c.items[item.Key] = item
+	}
+}
+
+// Set sets the value of an item and records where it came from.
+func (c *Config) Set(key string, value string, source string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.values[key] = value
+	c.sources[key] = source
+}
+
+// SetOverride sets an item from a name=value pair given on the command line.
+func (c *Config) SetOverride(pair string) error {
+	key, value, ok := strings.Cut(pair, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("invalid override (%s): expected name=value", pair)
+	}
+
+	c.Set(key, strings.TrimSpace(value), SourceCommandLine)
+	return nil
+}
+
+// LoadFile sets the items in a properties or YAML file. Files ending in .yaml or .yml are YAML. An error is
+// returned if the file cannot be read. Problems with its content are reported by Validate.
+func (c *Config) LoadFile(file string) error {
+	var values map[string]string
+	var err error
+
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		values, err = ReadYAML(file)
+	default:
+		values, err = ReadProperties(file)
+	}
+
+	if errs, ok := err.(Errors); ok {
+		c.problems = append(c.problems, errs...)
+	} else if err != nil {
+		return err
+	}
+
+	for k, v := range values {
+		c.Set(k, v, file)
+	}
+
+	return nil
+}
+
+// LoadEnv sets the items in environment variables that have the prefix.
+func (c *Config) LoadEnv(prefix string) {
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, prefix) || name == prefix {
+			continue
+		}
+
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, prefix), "_", "-"))
+		c.Set(key, value, sourceEnvironment)
+	}
+}
+
+// lookup returns the value of an item, or its default if it has not been set.
+func (c *Config) lookup(key string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.valueLocked(key)
+}
+
+// defaultOf returns the default value of an item.
+func (c *Config) defaultOf(key string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.items[key].Default
+}
+
+// IsSet returns true if the item has been given a value, rather than falling back to its default.
+func (c *Config) IsSet(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.values[key] != ""
+}
+
+// String returns the value of an item.
+func (c *Config) String(key string) string {
+	return c.lookup(key)
+}
+
+// Int returns the integer value of an item. If the value is not a valid integer the default is returned.
+func (c *Config) Int(key string) int {
+	value := c.lookup(key)
+	if value == "" {
+		return 0
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("WARNING: Invalid integer for configuration item %s (%s). Using default: %s", key, value, c.defaultOf(key))
+		i, _ = strconv.Atoi(c.defaultOf(key))
+	}
+
+	return i
+}
+
+// Float returns the numeric value of an item. If the value is not a valid number the default is returned.
+func (c *Config) Float(key string) float64 {
+	value := c.lookup(key)
+	if value == "" {
+		return 0
+	}
+
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("WARNING: Invalid number for configuration item %s (%s). Using default: %s", key, value, c.defaultOf(key))
+		f, _ = strconv.ParseFloat(c.defaultOf(key), 64)
+	}
+
+	return f
+}
+
+// Bool returns the boolean value of an item. If the value is not a valid boolean the default is returned.
+func (c *Config) Bool(key string) bool {
+	value := c.lookup(key)
+	if value == "" {
+		return false
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("WARNING: Invalid boolean for configuration item %s (%s). Using default: %s", key, value, c.defaultOf(key))
+		b, _ = strconv.ParseBool(c.defaultOf(key))
+	}
+
+	return b
+}
+
+// List returns the comma-separated values of an item with the spaces trimmed and empty values removed.
+func (c *Config) List(key string) []string {
+	return SplitList(c.lookup(key))
+}
+
+// SplitList splits a comma-separated list, trimming the spaces and removing empty values.
+func SplitList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// Summary lists the value of every item that is set or has a default, and where the value came from. The values of
+// secret items are masked.
+func (c *Config) Summary() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	keys := make(map[string]bool)
+	for k := range c.values {
+		keys[k] = true
+	}
+	for k, item := range c.items {
+		if item.Default != "" {
+			keys[k] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var b strings.Builder
+	for _, k := range sorted {
+		value, source := c.values[k], c.sources[k]
+		if value == "" && c.items[k].Default != "" {
+			value, source = c.items[k].Default, sourceDefault
+		}
+		fmt.Fprintf(&b, "  %s=%s (%s)\n", k, c.items[k].shown(value), source)
+	}
+
+	return b.String()
+}
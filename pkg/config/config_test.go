@@ -0,0 +1,162 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes a configuration file to a temporary directory and returns its path.
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// testItems are the items registered by the tests.
+var testItems = []Item{
+	{Key: "data-source", Kind: KindString, Default: "simulator", Options: []string{"simulator", "co2-signal", "entsoe"}},
+	{Key: "data-publisher", Kind: KindList, Default: "console-publisher",
+		Options: []string{"console-publisher", "kafka-publisher", "webhook-publisher"}},
+	{Key: "time-reader-interval", Kind: KindInt, Default: "3600", Check: AtLeast(1)},
+	{Key: "http-timeout", Kind: KindInt, Default: "30", Check: AtLeast(1)},
+	{Key: "kafka-topic", Kind: KindString},
+	{Key: "zone-filter", Kind: KindList},
+	{Key: "webhook-urls", Kind: KindList, RequiredIf: When("data-publisher", "webhook-publisher")},
+	{Key: "webhook-headers", Kind: KindList, Secret: true},
+	{Key: "simulator-noise", Kind: KindFloat, Default: "0.05", Check: AtLeast(0)},
+	{Key: "uk-carbon-intensity-forecast", Kind: KindBool, Default: "true"},
+}
+
+func newTestConfig() *Config {
+	c := New()
+	c.Register(testItems...)
+
+	return c
+}
+
+// TestPrecedence loads each layer in the order the service does: the file, then the environment, then the
+// command line. Each layer overrides the one before, and items no layer sets have their default.
+func TestPrecedence(t *testing.T) {
+	properties := writeFile(t, "app-config.properties", `
+# Comment
+data-source=co2-signal
+time-reader-interval=600
+http-timeout=10
+kafka-topic=from-file
+`)
+	yamlFile := writeFile(t, "app-config.yaml", `
+data-source: co2-signal
+time-reader:
+  interval: 600
+http:
+  timeout: 10
+kafka:
+  topic: from-file
+`)
+
+	for _, file := range []string{properties, yamlFile} {
+		t.Run(filepath.Ext(file), func(t *testing.T) {
+			t.Setenv(EnvPrefix+"TIME_READER_INTERVAL", "300")
+			t.Setenv(EnvPrefix+"KAFKA_TOPIC", "from-environment")
+
+			c := newTestConfig()
+			if err := c.LoadFile(file); err != nil {
+				t.Fatalf("LoadFile() error = %v", err)
+			}
+			c.LoadEnv(EnvPrefix)
+			if err := c.SetOverride("kafka-topic=from-command-line"); err != nil {
+				t.Fatalf("SetOverride() error = %v", err)
+			}
+			if err := c.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+
+			tests := []struct {
+				key  string
+				want string
+			}{
+				{key: "data-source", want: "co2-signal"},        // File.
+				{key: "http-timeout", want: "10"},               // File.
+				{key: "time-reader-interval", want: "300"},      // Environment over file.
+				{key: "kafka-topic", want: "from-command-line"}, // Command line over environment and file.
+				{key: "simulator-noise", want: "0.05"},          // Default.
+			}
+			for _, tt := range tests {
+				if got := c.String(tt.key); got != tt.want {
+					t.Errorf("%s = %s, want %s", tt.key, got, tt.want)
+				}
+			}
+
+			if got := c.Int("time-reader-interval"); got != 300 {
+				t.Errorf("Int(time-reader-interval) = %d, want 300", got)
+			}
+			if got := c.Float("simulator-noise"); got != 0.05 {
+				t.Errorf("Float(simulator-noise) = %g, want 0.05", got)
+			}
+			if !c.Bool("uk-carbon-intensity-forecast") {
+				t.Error("Bool(uk-carbon-intensity-forecast) = false, want the default true")
+			}
+			if c.IsSet("simulator-noise") || !c.IsSet("kafka-topic") {
+				t.Error("IsSet() does not tell set items from defaults")
+			}
+		})
+	}
+}
+
+func TestSetOverrideInvalid(t *testing.T) {
+	for _, pair := range []string{"kafka-topic", "=value", " =value"} {
+		if err := newTestConfig().SetOverride(pair); err == nil {
+			t.Errorf("SetOverride(%q) succeeded, want an error", pair)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := SplitList(" AUS-*, ,US-*,,!US-AK ")
+	want := []string{"AUS-*", "US-*", "!US-AK"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("SplitList() = %q, want %q", got, want)
+	}
+}
+
+// TestSummaryMasksSecrets checks that the values of secret items are masked in the configuration that is logged
+// on start, and other values are shown with where they came from.
+func TestSummaryMasksSecrets(t *testing.T) {
+	c := newTestConfig()
+	c.Set("webhook-headers", "Authorization:Bearer abc123", SourceCommandLine)
+	c.Set("kafka-topic", "co2signal", "app-config.properties")
+
+	summary := c.Summary()
+	if strings.Contains(summary, "abc123") {
+		t.Errorf("Summary() shows a secret:\n%s", summary)
+	}
+	for _, line := range []string{
+		"webhook-headers=" + maskedValue + " (command line)",
+		"kafka-topic=co2signal (app-config.properties)",
+		"time-reader-interval=3600 (default)",
+	} {
+		if !strings.Contains(summary, "  "+line+"\n") {
+			t.Errorf("Summary() does not have %q:\n%s", line, summary)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReadProperties loads a name/value file. Entries have the format: name=value. Lines starting with # are
+// comments. The value is everything after the first =, so it may contain = itself. If any line is not a valid
+// entry the valid entries are still returned, along with an Errors listing every invalid line.
+func ReadProperties(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := make(map[string]string)
+	var errs Errors
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			errs = append(errs, fmt.Errorf("%s:%d: expected name=value: %s", file, n, line))
+			continue
+		}
+		m[name] = strings.TrimSpace(value)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, errs.OrNil()
+}
+
+// ReadYAML loads a YAML file of configuration items. Nested mappings are flattened by joining the keys with a
+// hyphen, so "kafka: {topic: co2signal}" sets kafka-topic. A sequence becomes a comma-separated list.
+func ReadYAML(file string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, Errors{fmt.Errorf("%s: %v", file, err)}
+	}
+
+	m := make(map[string]string)
+	var errs Errors
+	flattenYAML(file, "", doc, m, &errs)
+
+	return m, errs.OrNil()
+}
+
+// flattenYAML adds the values in a YAML mapping to m, prefixing each key with the keys of its parents.
+func flattenYAML(file string, prefix string, node map[string]interface{}, m map[string]string, errs *Errors) {
+	for k, v := range node {
+		key := prefix + k
+
+		switch value := v.(type) {
+		case nil:
+			m[key] = ""
+		case map[string]interface{}:
+			flattenYAML(file, key+"-", value, m, errs)
+		case []interface{}:
+			items := make([]string, 0, len(value))
+			for _, item := range value {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}:
+					*errs = append(*errs, fmt.Errorf("%s: %s: list items must be values", file, key))
+				default:
+					items = append(items, fmt.Sprint(item))
+				}
+			}
+			m[key] = strings.Join(items, ",")
+		default:
+			m[key] = fmt.Sprint(value)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadProperties(t *testing.T) {
+	file := writeFile(t, "app-config.properties", `
+# A comment
+  data-source = co2-signal
+webhook-headers=Authorization:Bearer a=b
+empty=
+`)
+
+	got, err := ReadProperties(file)
+	if err != nil {
+		t.Fatalf("ReadProperties() error = %v", err)
+	}
+
+	want := map[string]string{"data-source": "co2-signal", "webhook-headers": "Authorization:Bearer a=b", "empty": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadProperties() = %v, want %v", got, want)
+	}
+}
+
+func TestReadYAML(t *testing.T) {
+	file := writeFile(t, "app-config.yaml", `
+data-source: entsoe
+time-reader:
+  interval: 600
+zone:
+  filter: [DE, FR, "!GB"]
+uk-carbon-intensity:
+  forecast: false
+checkpoint-file:
+`)
+
+	got, err := ReadYAML(file)
+	if err != nil {
+		t.Fatalf("ReadYAML() error = %v", err)
+	}
+
+	want := map[string]string{
+		"data-source":                  "entsoe",
+		"time-reader-interval":         "600",
+		"zone-filter":                  "DE,FR,!GB",
+		"uk-carbon-intensity-forecast": "false",
+		"checkpoint-file":              "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadYAML() = %v, want %v", got, want)
+	}
+}
+
+func TestReadYAMLInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "not YAML", content: "data-source: [entsoe"},
+		{name: "nested list", content: "zone-filter:\n  - [DE, FR]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadYAML(writeFile(t, "app-config.yaml", tt.content)); err == nil {
+				t.Error("ReadYAML() succeeded, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Errors is a list of problems that are reported together.
+type Errors []error
+
+// Error lists each problem on its own line.
+func (e Errors) Error() string {
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  " + err.Error()
+	}
+
+	return fmt.Sprintf("%d configuration problems:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+// OrNil returns nil if there are no problems, so an empty list is not mistaken for an error.
+func (e Errors) OrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// AtLeast returns a Check that the value is a number no smaller than min.
+func AtLeast(min float64) func(string) error {
+	return func(value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < min {
+			return fmt.Errorf("must be at least %g", min)
+		}
+
+		return nil
+	}
+}
+
+// Validate checks every item: required items are set, values have the right kind, values are one of the item's
+// options and pass its Check. It returns an Errors listing every problem, including any found while loading.
+// Items that are set but not registered are logged as warnings, since they are most likely misspelt.
+func (c *Config) Validate() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	errs := append(Errors{}, c.problems...)
+
+	keys := make([]string, 0, len(c.items))
+	for k := range c.items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		item := c.items[key]
+		value := c.values[key]
+
+		if value == "" {
+			if item.Required {
+				errs = append(errs, fmt.Errorf("%s is required%s", key, optionsHint(item)))
+			} else if cond := item.RequiredIf; cond != nil && contains(SplitList(c.valueLocked(cond.Key)), cond.Value) {
+				errs = append(errs, fmt.Errorf("%s is required when %s=%s", key, cond.Key, cond.Value))
+			}
+			continue
+		}
+
+		if err := checkKind(item.Kind, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s, from %s) must be %v", key, item.shown(value), c.sources[key], item.Kind))
+			continue
+		}
+
+		if invalid := invalidOptions(item, value); len(invalid) > 0 {
+			errs = append(errs, fmt.Errorf("%s (%s, from %s) is not valid%s", key, strings.Join(invalid, ","),
+				c.sources[key], optionsHint(item)))
+			continue
+		}
+
+		if item.Check != nil {
+			if err := item.Check(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s (%s, from %s): %v", key, item.shown(value), c.sources[key], err))
+			}
+		}
+	}
+
+	unknown := make([]string, 0)
+	for k := range c.values {
+		if _, ok := c.items[k]; !ok {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		log.Printf("WARNING: Unknown configuration item %s (from %s) is ignored", k, c.sources[k])
+	}
+
+	return errs.OrNil()
+}
+
+// valueLocked returns the value of an item, or its default. The caller must hold the mutex.
+func (c *Config) valueLocked(key string) string {
+	if v := c.values[key]; v != "" {
+		return v
+	}
+
+	return c.items[key].Default
+}
+
+// checkKind returns an error if the value cannot be parsed as the kind.
+func checkKind(kind Kind, value string) error {
+	var err error
+	switch kind {
+	case KindInt:
+		_, err = strconv.Atoi(value)
+	case KindFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case KindBool:
+		_, err = strconv.ParseBool(value)
+	}
+
+	return err
+}
+
+// invalidOptions returns the values that are not one of the item's options. Each value of a list is checked.
+func invalidOptions(item Item, value string) []string {
+	if len(item.Options) == 0 {
+		return nil
+	}
+
+	values := []string{value}
+	if item.Kind == KindList {
+		values = SplitList(value)
+	}
+
+	var invalid []string
+	for _, v := range values {
+		if !contains(item.Options, v) {
+			invalid = append(invalid, v)
+		}
+	}
+
+	return invalid
+}
+
+// optionsHint describes the valid values of an item, if it has a fixed set.
+func optionsHint(item Item) string {
+	if len(item.Options) == 0 {
+		return ""
+	}
+
+	return ". Options are: " + strings.Join(item.Options, ", ")
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
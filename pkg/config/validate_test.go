@@ -0,0 +1,146 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   []string // A part of each problem reported, in order. Empty means the configuration is valid.
+	}{
+		{name: "defaults"},
+		{
+			name:   "required when the publisher is in a list",
+			values: map[string]string{"data-publisher": "console-publisher, webhook-publisher"},
+			want:   []string{"webhook-urls is required when data-publisher=webhook-publisher"},
+		},
+		{
+			name:   "required item is set",
+			values: map[string]string{"data-publisher": "webhook-publisher", "webhook-urls": "https://example.com"},
+		},
+		{
+			name:   "condition does not hold",
+			values: map[string]string{"data-publisher": "kafka-publisher"},
+		},
+		{
+			name:   "below the minimum",
+			values: map[string]string{"time-reader-interval": "0", "simulator-noise": "-0.5"},
+			want: []string{
+				"simulator-noise (-0.5, from test): must be at least 0",
+				"time-reader-interval (0, from test): must be at least 1",
+			},
+		},
+		{
+			name:   "wrong kind",
+			values: map[string]string{"http-timeout": "ten", "uk-carbon-intensity-forecast": "maybe"},
+			want: []string{
+				"http-timeout (ten, from test) must be an integer",
+				"uk-carbon-intensity-forecast (maybe, from test) must be true or false",
+			},
+		},
+		{
+			name:   "not an option",
+			values: map[string]string{"data-source": "watttime", "data-publisher": "console-publisher,nats-publisher"},
+			want: []string{
+				"data-publisher (nats-publisher, from test) is not valid. Options are: console-publisher",
+				"data-source (watttime, from test) is not valid. Options are: simulator",
+			},
+		},
+		{
+			name:   "unknown items are not problems",
+			values: map[string]string{"time-reader-intervall": "600"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig()
+			for k, v := range tt.values {
+				c.Set(k, v, "test")
+			}
+
+			err := c.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+
+			var errs Errors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Validate() error = %v, want Errors", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Fatalf("Validate() reported %d problems, want %d:\n%v", len(errs), len(tt.want), err)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(errs[i].Error(), want) {
+					t.Errorf("problem %d = %q, want %q", i, errs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateRequired(t *testing.T) {
+	c := New()
+	c.Register(Item{Key: "reader", Kind: KindString, Required: true, Options: []string{"time-reader", "one-shot"}})
+
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "reader is required. Options are: time-reader, one-shot") {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+// TestValidateMasksSecrets checks that a secret that fails validation is not shown in the problem.
+func TestValidateMasksSecrets(t *testing.T) {
+	c := New()
+	c.Register(Item{Key: "api-key", Kind: KindString, Secret: true, Check: func(string) error {
+		return errors.New("must be 32 characters")
+	}})
+	c.Set("api-key", "secret-key", "test")
+
+	err := c.Validate()
+	if err == nil || strings.Contains(err.Error(), "secret-key") || !strings.Contains(err.Error(), maskedValue) {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+// TestValidateReportsLoadProblems checks that problems found while loading the file are reported with the others.
+func TestValidateReportsLoadProblems(t *testing.T) {
+	file := writeFile(t, "app-config.properties", "kafka-topic=co2signal\nnot an entry\nhttp-timeout=0\n")
+
+	c := newTestConfig()
+	if err := c.LoadFile(file); err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+
+	var errs Errors
+	if err := c.Validate(); !errors.As(err, &errs) || len(errs) != 2 {
+		t.Fatalf("Validate() error = %v, want 2 problems", err)
+	}
+	if !strings.Contains(errs[0].Error(), ":2: expected name=value: not an entry") {
+		t.Errorf("problem 0 = %v", errs[0])
+	}
+	if !strings.Contains(errs[1].Error(), "http-timeout (0, from "+file+")") {
+		t.Errorf("problem 1 = %v", errs[1])
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// Configuration items for the CompositePublisher.
+const (
+	compositeQueueSizeConfigItem = "composite-publisher-queue-size" // Readings that can wait for each publisher.
+)
+
+// Defaults used if the configuration file does not set the CompositePublisher items.
+const (
+	defaultCompositeQueueSize = "1000"
+)
+
+// compositeConfigItems returns the configuration items used by the CompositePublisher.
+func compositeConfigItems() []config.Item {
+	return []config.Item{
+		{Key: compositeQueueSizeConfigItem, Kind: config.KindInt, Default: defaultCompositeQueueSize, Check: config.AtLeast(1)},
+	}
+}
+
+// CompositePublisher is an implementation of the IDataPublisher that delivers every reading to each of a list of
+// publishers, e.g. to Kafka and to a local archive. Each publisher has its own queue and goroutine, so one that is
+// failing or slow does not hold up the others. If a publisher's queue is full the reading is not delivered to it.
+// Deliveries and failures are counted per publisher. The DeliveryReport for a reading is sent once every publisher
+// has reported, and has an error if any of them failed to deliver it.
+type CompositePublisher struct {
+	reports chan DeliveryReport
+	sinks   []*compositeSink
+	mutex   sync.Mutex     // Guards the deliveries in progress and the counts.
+	running sync.WaitGroup // The goroutines that read the reports of each publisher.
+}
+
+// compositeSink is one of the publishers a CompositePublisher delivers to.
+type compositeSink struct {
+	name      string
+	publisher IDataPublisher
+	queue     chan compositeMessage // Readings waiting to be published.
+	reports   chan DeliveryReport   // The publisher's delivery reports.
+	published chan struct{}         // Closed when every reading in the queue has been passed to the publisher.
+	delivered int
+	failed    int
+}
+
+// compositeMessage is a reading waiting in a publisher's queue.
+type compositeMessage struct {
+	key      string
+	data     string
+	delivery *compositeDelivery
+}
+
+// compositeDelivery tracks a reading until every publisher has reported whether it was delivered.
+type compositeDelivery struct {
+	key       string
+	opaque    interface{}
+	remaining int      // Publishers that have not reported.
+	errs      []string // Why publishers failed to deliver the reading.
+}
+
+// AddPublisher adds a publisher that readings are delivered to. The name identifies it in the log. Publishers
+// must be added before Initialise is called.
+func (p *CompositePublisher) AddPublisher(name string, publisher IDataPublisher) {
+	p.sinks = append(p.sinks, &compositeSink{name: name, publisher: publisher})
+}
+
+// Initialise initialises each publisher and starts the goroutines that deliver to it.
+func (p *CompositePublisher) Initialise() {
+	if len(p.sinks) == 0 {
+		log.Fatalf("CompositePublisher::Initialise(): No publishers have been added")
+	}
+
+	queueSize := config.App().Int(compositeQueueSizeConfigItem)
+
+	names := make([]string, len(p.sinks))
+	for i, sink := range p.sinks {
+		names[i] = sink.name
+		sink.queue = make(chan compositeMessage, queueSize)
+		sink.reports = make(chan DeliveryReport, queueSize)
+		sink.published = make(chan struct{})
+
+		sink.publisher.Initialise()
+		sink.publisher.SetDeliveryChannel(sink.reports)
+
+		p.running.Add(1)
+		go p.publish(sink)
+		go p.handleReports(sink)
+	}
+
+	log.Printf("CompositePublisher delivering to %s", strings.Join(names, ", "))
+}
+
+// Assign the channel that delivery reports are sent on.
+func (p *CompositePublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+// PublishData queues the reading for each publisher and returns without waiting for them.
+func (p *CompositePublisher) PublishData(key string, data string, opaque interface{}) error {
+	if len(p.sinks) == 0 || p.sinks[0].queue == nil {
+		return errors.New("CompositePublisher is not initialised")
+	}
+
+	delivery := &compositeDelivery{key: key, opaque: opaque, remaining: len(p.sinks)}
+	for _, sink := range p.sinks {
+		select {
+		case sink.queue <- compositeMessage{key: key, data: data, delivery: delivery}:
+		default:
+			p.settle(sink, delivery, fmt.Errorf("%d readings are already waiting", cap(sink.queue)))
+		}
+	}
+
+	return nil
+}
+
+// publish passes the readings in a publisher's queue to it until the queue is closed.
+func (p *CompositePublisher) publish(sink *compositeSink) {
+	defer close(sink.published)
+
+	for m := range sink.queue {
+		if err := sink.publisher.PublishData(m.key, m.data, m.delivery); err != nil {
+			p.settle(sink, m.delivery, err)
+		}
+	}
+}
+
+// handleReports records the delivery reports of a publisher until its reports channel is closed.
+func (p *CompositePublisher) handleReports(sink *compositeSink) {
+	defer p.running.Done()
+
+	for r := range sink.reports {
+		delivery, ok := r.Opaque.(*compositeDelivery)
+		if !ok {
+			log.Printf("ERROR: CompositePublisher: Delivery report from %s for %s is not for a reading", sink.name, r.Key)
+			continue
+		}
+		p.settle(sink, delivery, r.Err)
+	}
+}
+
+// settle records whether a publisher delivered a reading. When the last publisher has reported, the reading's
+// DeliveryReport is sent.
+func (p *CompositePublisher) settle(sink *compositeSink, delivery *compositeDelivery, err error) {
+	p.mutex.Lock()
+	if err != nil {
+		log.Printf("ERROR: CompositePublisher: %s failed to deliver the reading for %s: %v", sink.name, delivery.key, err)
+		sink.failed++
+		delivery.errs = append(delivery.errs, fmt.Sprintf("%s: %v", sink.name, err))
+	} else {
+		sink.delivered++
+	}
+	delivery.remaining--
+	done := delivery.remaining == 0
+	p.mutex.Unlock()
+
+	if !done {
+		return
+	}
+
+	err = nil
+	if len(delivery.errs) > 0 {
+		err = fmt.Errorf("not delivered by %s", strings.Join(delivery.errs, "; "))
+	}
+	report(p.reports, delivery.key, delivery.opaque, err)
+}
+
+// Clean up any resources on exit. Each publisher is given the readings left in its queue and then cleaned up.
+// The number of readings each publisher delivered and failed to deliver is logged.
+func (p *CompositePublisher) Cleanup() {
+	if len(p.sinks) == 0 || p.sinks[0].queue == nil {
+		return
+	}
+
+	// Clean up the publishers in parallel so one that is slow to flush does not delay the others.
+	var cleanups sync.WaitGroup
+	for _, sink := range p.sinks {
+		cleanups.Add(1)
+		go func(sink *compositeSink) {
+			defer cleanups.Done()
+
+			close(sink.queue)
+			<-sink.published
+			sink.publisher.Cleanup()
+		}(sink)
+	}
+	cleanups.Wait()
+
+	for _, sink := range p.sinks {
+		close(sink.reports)
+	}
+	p.running.Wait()
+
+	for _, sink := range p.sinks {
+		log.Printf("CompositePublisher: %s delivered %d readings and failed to deliver %d", sink.name, sink.delivered,
+			sink.failed)
+	}
+}
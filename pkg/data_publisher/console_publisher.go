@@ -19,12 +19,21 @@ import (
 )
 
 type ConsolePublisher struct {
+	reports chan DeliveryReport
 }
 
-func (p *ConsolePublisher) PublishData(key string, data string) {
+// Assign the channel that delivery reports are sent on.
+func (p *ConsolePublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+func (p *ConsolePublisher) PublishData(key string, data string, opaque interface{}) error {
 	fmt.Printf("ConsolePublisher::PublishData()\n")
 
 	fmt.Printf("Key: %s\nData: %s\n", key, data)
+
+	report(p.reports, key, opaque, nil)
+	return nil
 }
 
 func (p *ConsolePublisher) Initialise() {
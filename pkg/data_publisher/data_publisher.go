@@ -14,8 +14,42 @@
 
 package data_publisher
 
+import "os-climate.org/carbon-intensity/pkg/config"
+
+// DeliveryReport tells the caller whether a message passed to PublishData reached its destination.
+type DeliveryReport struct {
+	Key    string
+	Opaque interface{} // The value passed to PublishData, so the caller can tie the report back to its reading.
+	Err    error       // nil if the message was delivered.
+}
+
+// IDataPublisher defines the interface that all publishers should implement.
+// PublishData may deliver the message asynchronously. For every call that returns nil exactly one DeliveryReport
+// is sent on the delivery channel, which must be set before PublishData is called. The caller must keep reading
+// the delivery channel, or PublishData may block. No reports are sent after Cleanup returns.
 type IDataPublisher interface {
 	Initialise()
-	PublishData(string, string)
+	SetDeliveryChannel(chan DeliveryReport)
+	PublishData(key string, data string, opaque interface{}) error
 	Cleanup()
 }
+
+// ConfigItems returns the configuration items used by the publishers.
+func ConfigItems() []config.Item {
+	items := kafkaConfigItems()
+	items = append(items, fileConfigItems()...)
+	items = append(items, parquetConfigItems()...)
+	items = append(items, webhookConfigItems()...)
+	items = append(items, mqttConfigItems()...)
+	items = append(items, natsConfigItems()...)
+	items = append(items, compositeConfigItems()...)
+
+	return items
+}
+
+// report sends a delivery report if a delivery channel has been set.
+func report(reports chan DeliveryReport, key string, opaque interface{}, err error) {
+	if reports != nil {
+		reports <- DeliveryReport{Key: key, Opaque: opaque, Err: err}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// Configuration items for the FilePublisher.
+const (
+	fileDirConfigItem      = "file-publisher-dir"       // Directory the files are written to.
+	filePrefixConfigItem   = "file-publisher-prefix"    // Start of each file name.
+	fileRotationConfigItem = "file-publisher-rotation"  // How often a new file is started. See the fileRotation* values.
+	fileMaxBytesConfigItem = "file-publisher-max-bytes" // Bytes of NDJSON written to a file before a new one is started. 0 is unlimited.
+	fileGzipConfigItem     = "file-publisher-gzip"      // Compress the files with gzip.
+)
+
+// How often the FilePublisher starts a new file.
+const (
+	fileRotationHourly = "hourly"
+	fileRotationDaily  = "daily"
+)
+
+// Defaults used if the configuration file does not set the FilePublisher items.
+const (
+	defaultFileDir      = "./data"
+	defaultFilePrefix   = "carbon-intensity"
+	defaultFileMaxBytes = "104857600" // 100 MiB
+)
+
+// Suffix of a file that is still being written. It is removed when the file is rotated or the publisher is
+// cleaned up, so a collector can safely pick up any file without it.
+const partialFileSuffix = ".part"
+
+// fileConfigItems returns the configuration items used by the FilePublisher.
+func fileConfigItems() []config.Item {
+	return []config.Item{
+		{Key: fileDirConfigItem, Kind: config.KindString, Default: defaultFileDir},
+		{Key: filePrefixConfigItem, Kind: config.KindString, Default: defaultFilePrefix},
+		{Key: fileRotationConfigItem, Kind: config.KindString, Default: fileRotationHourly,
+			Options: []string{fileRotationHourly, fileRotationDaily}},
+		{Key: fileMaxBytesConfigItem, Kind: config.KindInt, Default: defaultFileMaxBytes, Check: config.AtLeast(0)},
+		{Key: fileGzipConfigItem, Kind: config.KindBool, Default: "false"},
+	}
+}
+
+// FilePublisher is an implementation of the IDataPublisher that appends each reading to a local file as one line
+// of JSON (NDJSON). A new file is started every hour or day (UTC), and when a file reaches its maximum size, so
+// readings can be collected without a Kafka cluster. Files are named <prefix>-<period>.<sequence>.ndjson, with a
+// .gz suffix if they are compressed.
+type FilePublisher struct {
+	mutex        sync.Mutex
+	reports      chan DeliveryReport
+	dir          string
+	prefix       string
+	periodLayout string // Time layout that names the period a file covers.
+	maxBytes     int64
+	gzip         bool
+
+	file    *os.File
+	gz      *gzip.Writer
+	out     io.Writer // The file, or the gzip writer over it.
+	path    string    // The name the file is renamed to when it is complete.
+	period  string
+	written int64 // Bytes of NDJSON written to the current file, before compression.
+}
+
+// Initialise reads the settings from the configuration file and creates the output directory.
+func (p *FilePublisher) Initialise() {
+	appConfig := config.App()
+
+	p.dir = appConfig.String(fileDirConfigItem)
+	p.prefix = appConfig.String(filePrefixConfigItem)
+	p.maxBytes = int64(appConfig.Int(fileMaxBytesConfigItem))
+	p.gzip = appConfig.Bool(fileGzipConfigItem)
+
+	p.periodLayout = "2006-01-02T15"
+	if appConfig.String(fileRotationConfigItem) == fileRotationDaily {
+		p.periodLayout = "2006-01-02"
+	}
+
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		log.Fatalf("FilePublisher::Initialise(): Failed to create %s: %v", p.dir, err)
+	}
+
+	log.Printf("FilePublisher writing to %s: rotation=%s max-bytes=%d gzip=%v", p.dir,
+		appConfig.String(fileRotationConfigItem), p.maxBytes, p.gzip)
+}
+
+// Assign the channel that delivery reports are sent on.
+func (p *FilePublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+// PublishData appends the reading to the current file. The data must be a JSON object; it is written on a single
+// line. The write is flushed to the file before the delivery report is sent.
+func (p *FilePublisher) PublishData(key string, data string, opaque interface{}) error {
+	fmt.Printf("FilePublisher::PublishData()\n")
+
+	var line bytes.Buffer
+	if err := json.Compact(&line, []byte(data)); err != nil {
+		return fmt.Errorf("reading for %s is not valid JSON: %v", key, err)
+	}
+	line.WriteByte('\n')
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err := p.write(line.Bytes())
+	report(p.reports, key, opaque, err)
+	return nil
+}
+
+// write appends a line to the current file, rotating it first if its period has ended or it is full.
+func (p *FilePublisher) write(line []byte) error {
+	period := time.Now().UTC().Format(p.periodLayout)
+	full := p.maxBytes > 0 && p.written > 0 && p.written+int64(len(line)) > p.maxBytes
+	if p.file == nil || period != p.period || full {
+		if err := p.rotate(period); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.out.Write(line); err != nil {
+		return err
+	}
+	p.written += int64(len(line))
+
+	if p.gz != nil {
+		return p.gz.Flush()
+	}
+
+	return nil
+}
+
+// rotate completes the current file, if there is one, and starts a new file for the period.
+func (p *FilePublisher) rotate(period string) error {
+	if err := p.closeFile(); err != nil {
+		log.Printf("WARNING: FilePublisher: Failed to complete %s: %v", p.path, err)
+	}
+
+	ext := ".ndjson"
+	if p.gzip {
+		ext += ".gz"
+	}
+
+	// Use the first sequence number that is not taken, so files from an earlier run are never overwritten.
+	for seq := 0; ; seq++ {
+		path := filepath.Join(p.dir, fmt.Sprintf("%s-%s.%d%s", p.prefix, period, seq, ext))
+		if fileExists(path) || fileExists(path+partialFileSuffix) {
+			continue
+		}
+
+		file, err := os.OpenFile(path+partialFileSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+
+		p.file, p.path, p.period, p.written = file, path, period, 0
+		p.out = file
+		if p.gzip {
+			p.gz = gzip.NewWriter(file)
+			p.out = p.gz
+		}
+
+		log.Printf("FilePublisher: Writing to %s", path+partialFileSuffix)
+		return nil
+	}
+}
+
+// closeFile closes the current file and removes its partial suffix.
+func (p *FilePublisher) closeFile() error {
+	if p.file == nil {
+		return nil
+	}
+
+	// Keep the first error, but always try to close and rename the file.
+	var err error
+	if p.gz != nil {
+		err = p.gz.Close()
+	}
+	if closeErr := p.file.Close(); err == nil {
+		err = closeErr
+	}
+	if renameErr := os.Rename(p.path+partialFileSuffix, p.path); err == nil {
+		err = renameErr
+	}
+
+	p.file, p.gz, p.out = nil, nil, nil
+	return err
+}
+
+// fileExists returns true if there is a file at the path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Clean up any resources on exit. The current file is completed.
+func (p *FilePublisher) Cleanup() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err := p.closeFile(); err != nil {
+		log.Printf("WARNING: FilePublisher: Failed to complete %s: %v", p.path, err)
+	}
+}
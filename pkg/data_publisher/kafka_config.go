@@ -0,0 +1,156 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Environment variables with this prefix set a librdkafka property. The rest of the name is lower-cased and
+// underscores become dots, e.g. KAFKA_SASL_PASSWORD sets sasl.password.
+const kafkaEnvPrefix = "KAFKA_"
+
+// Environment variables that Kubernetes creates for a Service called "kafka". They are not librdkafka properties.
+var kubernetesServiceEnv = regexp.MustCompile(`^KAFKA_(SERVICE_|PORT$|PORT_)`)
+
+// Parts of a property name that mark its value as a secret that must not be logged.
+var secretKeyMarkers = []string{"password", "secret", ".pem", "sasl.jaas.config", "sasl.oauthbearer.config"}
+
+// The masked value that is logged in place of a secret.
+const maskedValue = "********"
+
+// kafkaConfig is the layered Kafka producer configuration. Later layers override earlier ones:
+//  1. The properties file (optional).
+//  2. KAFKA_* environment variables.
+//  3. Files in the secrets directory (optional). Each file name is a property and its content is the value, which
+//     is how a Kubernetes Secret mounted as a volume appears.
+type kafkaConfig struct {
+	conf    kafka.ConfigMap
+	secrets map[string]bool // Properties whose values came from the secrets directory.
+	sources map[string]string
+}
+
+// loadKafkaConfig builds the Kafka producer configuration from each layer.
+func loadKafkaConfig(propertiesFile string, secretsDir string) (*kafkaConfig, error) {
+	c := &kafkaConfig{conf: make(kafka.ConfigMap), secrets: make(map[string]bool), sources: make(map[string]string)}
+
+	if _, err := os.Stat(propertiesFile); err == nil {
+		properties, err := config.ReadProperties(propertiesFile)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range properties {
+			c.set(k, v, propertiesFile)
+		}
+	} else {
+		fmt.Printf("WARNING: Kafka properties file %s not found. Using the environment and secrets only.\n", propertiesFile)
+	}
+
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, kafkaEnvPrefix) || kubernetesServiceEnv.MatchString(name) {
+			continue
+		}
+
+		key := strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, kafkaEnvPrefix), "_", "."))
+		c.set(key, value, "environment")
+	}
+
+	if err := c.loadSecrets(secretsDir); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadSecrets reads each file in the secrets directory. A missing directory is not an error.
+func (c *kafkaConfig) loadSecrets(secretsDir string) error {
+	entries, err := ioutil.ReadDir(secretsDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		// Kubernetes mounts the keys of a Secret as symbolic links to hidden files, so skip directories and
+		// hidden entries and let ReadFile follow the links.
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		value, err := ioutil.ReadFile(filepath.Join(secretsDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		c.set(entry.Name(), strings.TrimSpace(string(value)), secretsDir)
+		c.secrets[entry.Name()] = true
+	}
+
+	return nil
+}
+
+// set sets a property and records where it came from.
+func (c *kafkaConfig) set(key string, value kafka.ConfigValue, source string) {
+	c.conf[key] = value
+	c.sources[key] = source
+}
+
+// isSecret returns true if the value of the property must not be logged.
+func (c *kafkaConfig) isSecret(key string) bool {
+	if c.secrets[key] {
+		return true
+	}
+
+	for _, marker := range secretKeyMarkers {
+		if strings.Contains(key, marker) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the configuration, one property per line, with secret values masked.
+func (c *kafkaConfig) String() string {
+	keys := make([]string, 0, len(c.conf))
+	for k := range c.conf {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		value := fmt.Sprint(c.conf[k])
+		if c.isSecret(k) {
+			value = maskedValue
+		}
+		fmt.Fprintf(&b, "%s=%s (from %s)\n", k, value, c.sources[k])
+	}
+
+	return b.String()
+}
@@ -15,57 +15,90 @@
 package data_publisher
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
+	"os-climate.org/carbon-intensity/pkg/config"
+
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
+// Configuration items for the Kafka topics.
+const (
+	kafkaTopicConfigItem       = "kafka-topic"         // The topic readings are published to.
+	legacyKafkaTopicConfigItem = "kafka-topc"          // The misspelt name used by older configuration files.
+	kafkaTopicRoutesConfigItem = "kafka-topic-routes"  // Routes that send some readings to other topics. See topicRouter.
+	kafkaMaxInFlightConfigItem = "kafka-max-in-flight" // Messages that can be waiting for delivery before PublishData blocks.
+	kafkaSecretsDirConfigItem  = "kafka-secrets-dir"   // Directory of files that hold secret Kafka properties. See kafkaConfig.
+)
+
+// The location of the Kafka properties file.
+const kafkaPropertiesFile = "./config/kafka.properties"
+
+// The secrets directory used if the configuration file does not set one.
+const defaultKafkaSecretsDir = "./secrets/kafka"
+
+// The number of messages that can be in flight if the configuration file does not set it.
+const defaultKafkaMaxInFlight = "1000"
+
+// How long Cleanup waits for messages in flight to be delivered.
+const kafkaFlushTimeoutMs = 15 * 1000
+
+// How long Cleanup waits for the delivery reports of the messages it purges.
+const kafkaPurgeTimeoutMs = 5 * 1000
+
+// The topic used if the configuration file does not set one.
+const defaultKafkaTopic = "co2signal"
+
+// kafkaConfigItems returns the configuration items used by the KafkaPublisher.
+func kafkaConfigItems() []config.Item {
+	return []config.Item{
+		{Key: kafkaTopicConfigItem, Kind: config.KindString, Default: defaultKafkaTopic},
+		{Key: legacyKafkaTopicConfigItem, Kind: config.KindString},
+		{Key: kafkaTopicRoutesConfigItem, Kind: config.KindList, Check: func(value string) error {
+			_, err := newTopicRouter(defaultKafkaTopic, value)
+			return err
+		}},
+		{Key: kafkaMaxInFlightConfigItem, Kind: config.KindInt, Default: defaultKafkaMaxInFlight, Check: config.AtLeast(1)},
+		{Key: kafkaSecretsDirConfigItem, Kind: config.KindString, Default: defaultKafkaSecretsDir},
+	}
+}
+
+// KafkaPublisher is an implementation of the IDataPublisher that produces messages asynchronously. Messages are
+// batched by the Kafka client, and the outcome of each is sent as a DeliveryReport when the broker acknowledges
+// it. The number of messages waiting for acknowledgement is bounded so a slow broker applies back-pressure.
 type KafkaPublisher struct {
 	initialised bool
+	router      *topicRouter
+	reports     chan DeliveryReport
+	inFlight    chan struct{} // Holds a token for every message waiting for a delivery report.
+	eventsDone  chan struct{} // Closed when the events goroutine has sent its last delivery report.
 }
 
-var topic = "co2signal" // TODO: Make this a config file option
 var kafkaProducer *kafka.Producer
-var config kafka.ConfigMap
-
-// Maps the environment vairable to the kafka property
-var envMap = map[string]string{
-	"KAFKA_BOOTSTRAP_SERVERS": "bootstrap.servers",
-	"KAFKA_SECURITY_PROTOCOL": "security.protocol",
-	"KAFKA_SASL_MECHANISMS":   "sasl.mechanisms",
-	"KAFKA_SASL_USERNAME":     "sasl.username",
-	"KAFKA_SASL_PASSWORD":     "sasl.password",
-	"KAFKA_ACKS":              "acks",
-}
 
-// the config from environment variables and build the ConfigMap
-func LoadConfigFromEnvironment() kafka.ConfigMap {
-	config = make(kafka.ConfigMap)
-
-	fmt.Printf("Loading Kafka environment variables:\n")
-	for key, value := range envMap {
-		env := os.Getenv(key)
-		fmt.Printf("%s:%s\n", value, env)
-		if env == "" {
-			fmt.Printf("ERROR: Missing environment variable %s.\n", key)
-			os.Exit(-1)
-		}
-		config[value] = env
+// Load the configuration file, environment and secrets, and establish the connection to the broker.
+func (p *KafkaPublisher) Initialise() {
+	secretsDir := config.App().String(kafkaSecretsDirConfigItem)
+
+	fmt.Printf("Reading Kafka config from: %s, %s* environment variables, %s\n", kafkaPropertiesFile, kafkaEnvPrefix, secretsDir)
+	layered, err := loadKafkaConfig(kafkaPropertiesFile, secretsDir)
+	if err != nil {
+		fmt.Printf("Failed to load the Kafka config: %s\n", err)
+		os.Exit(1)
 	}
+	fmt.Printf("Kafka config:\n%s", layered)
 
-	return config
-}
+	if err := p.loadTopics(); err != nil {
+		fmt.Printf("Failed to load the Kafka topics: %s\n", err)
+		os.Exit(1)
+	}
 
-// Load the configuration file and establish the connection to the broker.
-func (p *KafkaPublisher) Initialise() {
-	configFile := "./config/kafka.properties"
-	fmt.Printf("Reading config file from: %s\n", configFile)
-	conf := ReadConfig(configFile)
-	// conf := LoadConfigFromEnvironment()
+	p.inFlight = make(chan struct{}, config.App().Int(kafkaMaxInFlightConfigItem))
+	p.eventsDone = make(chan struct{})
 
-	var err error
-	kafkaProducer, err = kafka.NewProducer(&conf)
+	kafkaProducer, err = kafka.NewProducer(&layered.conf)
 
 	if err != nil {
 		fmt.Printf("Failed to create producer: %s", err)
@@ -75,15 +108,20 @@ func (p *KafkaPublisher) Initialise() {
 	// Go-routine to handle message delivery reports and
 	// possibly other event types (errors, stats, etc)
 	go func() {
+		defer close(p.eventsDone)
+
 		for e := range kafkaProducer.Events() {
 			switch ev := e.(type) {
 			case *kafka.Message:
 				if ev.TopicPartition.Error != nil {
 					fmt.Printf("Failed to deliver message: %v\n", ev.TopicPartition)
 				} else {
-					fmt.Printf("Produced event to topic %s: key = %-10s value = %s\n",
-						*ev.TopicPartition.Topic, string(ev.Key), string(ev.Value))
+					fmt.Printf("Produced event to topic %s: key = %-10s\n", *ev.TopicPartition.Topic, string(ev.Key))
 				}
+				<-p.inFlight
+				report(p.reports, string(ev.Key), ev.Opaque, ev.TopicPartition.Error)
+			case kafka.Error:
+				fmt.Printf("Kafka error: %v\n", ev)
 			}
 		}
 	}()
@@ -91,27 +129,80 @@ func (p *KafkaPublisher) Initialise() {
 	p.initialised = true
 }
 
-func (p *KafkaPublisher) PublishData(key string, data string) {
+// loadTopics reads the default topic and the topic routes from the application configuration file.
+func (p *KafkaPublisher) loadTopics() error {
+	appConfig := config.App()
+
+	topic := appConfig.String(kafkaTopicConfigItem)
+	if !appConfig.IsSet(kafkaTopicConfigItem) && appConfig.IsSet(legacyKafkaTopicConfigItem) {
+		fmt.Printf("WARNING: %s is deprecated. Use %s instead.\n", legacyKafkaTopicConfigItem, kafkaTopicConfigItem)
+		topic = appConfig.String(legacyKafkaTopicConfigItem)
+	}
+
+	router, err := newTopicRouter(topic, appConfig.String(kafkaTopicRoutesConfigItem))
+	if err != nil {
+		return err
+	}
+	p.router = router
+
+	fmt.Printf("Publishing to Kafka topic %s with %d routes\n", topic, len(router.routes))
+	return nil
+}
+
+// Assign the channel that delivery reports are sent on.
+func (p *KafkaPublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+// PublishData queues the message for delivery and returns without waiting for the broker. It blocks while the
+// maximum number of messages are in flight. The outcome is sent as a DeliveryReport.
+func (p *KafkaPublisher) PublishData(key string, data string, opaque interface{}) error {
 	fmt.Printf("KafkaPublisher::PublishData()\n")
 
 	if !p.initialised {
-		fmt.Printf("ERROR: KafkaPublisher in not initialised.")
-		os.Exit(-1)
+		return errors.New("KafkaPublisher is not initialised")
 	}
 
-	// fmt.Printf("Key: %s\nData: %s\n", key, data)
+	p.inFlight <- struct{}{}
 
-	kafkaProducer.Produce(&kafka.Message{
+	topic := p.router.topicFor(key, data)
+	err := kafkaProducer.Produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
 		Key:            []byte(key),
 		Value:          []byte(data),
+		Opaque:         opaque,
 	}, nil)
+	if err != nil {
+		// There will be no delivery report for a message that was not queued.
+		<-p.inFlight
+		return err
+	}
 
-	// Wait for all messages to be delivered
-	kafkaProducer.Flush(15 * 1000)
+	return nil
 }
 
-// Close the Kafka handle
+// Flush any messages that have not been delivered and close the Kafka handle
 func (p *KafkaPublisher) Cleanup() {
+	if !p.initialised {
+		return
+	}
+
+	// Wait for all messages to be delivered. Any that are not are purged, which gives each a delivery report with
+	// an error, so they are counted as failed and are not checkpointed.
+	if remaining := kafkaProducer.Flush(kafkaFlushTimeoutMs); remaining > 0 {
+		fmt.Printf("ERROR: %d messages were not delivered within %d ms. They are purged.\n", remaining, kafkaFlushTimeoutMs)
+		if err := kafkaProducer.Purge(kafka.PurgeQueue | kafka.PurgeInFlight); err != nil {
+			fmt.Printf("ERROR: Failed to purge the Kafka producer: %v\n", err)
+		}
+
+		// The events goroutine drains the reports of the purged messages.
+		if remaining := kafkaProducer.Flush(kafkaPurgeTimeoutMs); remaining > 0 {
+			fmt.Printf("ERROR: %d messages have no delivery report. They are lost.\n", remaining)
+		}
+	}
+
+	// Closing the producer closes the events channel, so wait for the last delivery report to be sent.
 	kafkaProducer.Close()
+	<-p.eventsDone
+	p.initialised = false
 }
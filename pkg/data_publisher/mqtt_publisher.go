@@ -0,0 +1,276 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Configuration items for the MQTTPublisher.
+const (
+	mqttBrokersConfigItem  = "mqtt-brokers"          // Comma-separated broker URLs, e.g. tcp://localhost:1883 or ssl://broker:8883.
+	mqttClientIDConfigItem = "mqtt-client-id"        // Client identifier. Defaults to carbon-intensity-<hostname>.
+	mqttUsernameConfigItem = "mqtt-username"         // User name. The password is read from the environment.
+	mqttTopicConfigItem    = "mqtt-topic-template"   // Template for the topic of each reading. See topicTemplate.
+	mqttQoSConfigItem      = "mqtt-qos"              // Quality of service: 0, 1 or 2.
+	mqttRetainedConfigItem = "mqtt-retained"         // Publish retained messages so subscribers get the latest reading at once.
+	mqttProtocolConfigItem = "mqtt-protocol-version" // MQTT protocol version: 3.1, 3.1.1 or 5.
+	mqttTimeoutConfigItem  = "mqtt-timeout"          // Seconds to wait to connect, and for each message to be acknowledged.
+	mqttCAFileConfigItem   = "mqtt-ca-file"          // PEM file of CA certificates for ssl:// brokers. Defaults to the system roots.
+)
+
+// Defaults used if the configuration file does not set the MQTTPublisher items.
+const (
+	defaultMQTTTopic    = "carbon/{country_code}/{zone}"
+	defaultMQTTQoS      = "1"
+	defaultMQTTRetained = "true"
+	defaultMQTTProtocol = "3.1.1"
+	defaultMQTTTimeout  = "30"
+)
+
+// The MQTT 3 protocol versions that can be configured, and their protocol level. Version 5 uses a different client.
+var mqttProtocolVersions = map[string]uint{
+	"3.1":   3,
+	"3.1.1": 4,
+}
+
+// The MQTT 5 protocol version.
+const mqttProtocolVersion5 = "5"
+
+// Environment variable that holds the broker password.
+const mqttPasswordEnvVar = "MQTT_PASSWORD"
+
+// How long Cleanup waits for work in progress before disconnecting, in milliseconds.
+const mqttDisconnectQuiesceMs = 1000
+
+// mqttConfigItems returns the configuration items used by the MQTTPublisher.
+func mqttConfigItems() []config.Item {
+	return []config.Item{
+		{Key: mqttBrokersConfigItem, Kind: config.KindList, RequiredIf: config.When("data-publisher", "mqtt-publisher")},
+		{Key: mqttClientIDConfigItem, Kind: config.KindString},
+		{Key: mqttUsernameConfigItem, Kind: config.KindString},
+		{Key: mqttTopicConfigItem, Kind: config.KindString, Default: defaultMQTTTopic, Check: func(value string) error {
+			_, err := newTopicTemplate(value, escapeMQTTTopic)
+			return err
+		}},
+		{Key: mqttQoSConfigItem, Kind: config.KindInt, Default: defaultMQTTQoS, Options: []string{"0", "1", "2"}},
+		{Key: mqttRetainedConfigItem, Kind: config.KindBool, Default: defaultMQTTRetained},
+		{Key: mqttProtocolConfigItem, Kind: config.KindString, Default: defaultMQTTProtocol, Options: []string{"3.1", "3.1.1", mqttProtocolVersion5}},
+		{Key: mqttTimeoutConfigItem, Kind: config.KindInt, Default: defaultMQTTTimeout, Check: config.AtLeast(1)},
+		{Key: mqttCAFileConfigItem, Kind: config.KindString},
+	}
+}
+
+// MQTTPublisher is an implementation of the IDataPublisher that publishes each reading to an MQTT broker, for
+// building-management and edge devices that do not speak Kafka. The topic is built from the reading by a template.
+// Messages are retained by default so a device gets the latest intensity for its zone as soon as it subscribes.
+// The client reconnects automatically if the connection to the broker is lost. MQTT 3.1, 3.1.1 and 5 are supported.
+type MQTTPublisher struct {
+	reports  chan DeliveryReport
+	client   mqttClient
+	topic    *topicTemplate
+	qos      byte
+	retained bool
+	timeout  time.Duration
+}
+
+// mqttClient is a connection to an MQTT broker using one version of the protocol.
+type mqttClient interface {
+	// publish sends a message and waits, up to the timeout, for the broker to acknowledge it at the quality of
+	// service.
+	publish(topic string, qos byte, retained bool, payload string, timeout time.Duration) error
+
+	// disconnect closes the connection once the work in progress is done, waiting at most
+	// mqttDisconnectQuiesceMs.
+	disconnect()
+}
+
+// mqttSettings are the settings used to connect to the broker.
+type mqttSettings struct {
+	brokers   []string
+	clientID  string
+	username  string
+	password  string
+	tlsConfig *tls.Config // nil uses the system roots for ssl:// brokers.
+	timeout   time.Duration
+}
+
+// Initialise reads the settings from the configuration file and connects to the broker.
+func (p *MQTTPublisher) Initialise() {
+	appConfig := config.App()
+
+	brokers := appConfig.List(mqttBrokersConfigItem)
+	if len(brokers) == 0 {
+		log.Fatalf("MQTTPublisher::Initialise(): %s is not set", mqttBrokersConfigItem)
+	}
+
+	var err error
+	p.topic, err = newTopicTemplate(appConfig.String(mqttTopicConfigItem), escapeMQTTTopic)
+	if err != nil {
+		log.Fatalf("MQTTPublisher::Initialise(): %v", err)
+	}
+	p.qos = byte(appConfig.Int(mqttQoSConfigItem))
+	p.retained = appConfig.Bool(mqttRetainedConfigItem)
+	p.timeout = time.Duration(appConfig.Int(mqttTimeoutConfigItem)) * time.Second
+
+	clientID := appConfig.String(mqttClientIDConfigItem)
+	if clientID == "" {
+		hostname, _ := os.Hostname()
+		clientID = "carbon-intensity-" + hostname
+	}
+
+	settings := mqttSettings{
+		brokers:  brokers,
+		clientID: clientID,
+		username: appConfig.String(mqttUsernameConfigItem),
+		password: os.Getenv(mqttPasswordEnvVar),
+		timeout:  p.timeout,
+	}
+	if caFile := appConfig.String(mqttCAFileConfigItem); caFile != "" {
+		settings.tlsConfig, err = loadTLSConfig(caFile)
+		if err != nil {
+			log.Fatalf("MQTTPublisher::Initialise(): %v", err)
+		}
+	}
+
+	version := appConfig.String(mqttProtocolConfigItem)
+	if version == mqttProtocolVersion5 {
+		p.client, err = connectMQTTv5(settings)
+	} else {
+		p.client, err = connectMQTTv3(settings, mqttProtocolVersions[version])
+	}
+	if err != nil {
+		log.Fatalf("MQTTPublisher::Initialise(): %v", err)
+	}
+
+	log.Printf("MQTTPublisher connected to %v as %s with MQTT %s: topic=%s qos=%d retained=%v", brokers, clientID,
+		version, p.topic.template, p.qos, p.retained)
+}
+
+// Assign the channel that delivery reports are sent on.
+func (p *MQTTPublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+// PublishData publishes the reading to the topic built from it, and waits for the broker to acknowledge it at the
+// configured quality of service.
+func (p *MQTTPublisher) PublishData(key string, data string, opaque interface{}) error {
+	fmt.Printf("MQTTPublisher::PublishData()\n")
+
+	if p.client == nil {
+		return errors.New("MQTTPublisher is not initialised")
+	}
+
+	topic, err := p.topic.expand(key, data)
+	if err != nil {
+		return err
+	}
+
+	err = p.client.publish(topic, p.qos, p.retained, data, p.timeout)
+	if err == nil {
+		fmt.Printf("Published to MQTT topic %s\n", topic)
+	}
+
+	report(p.reports, key, opaque, err)
+	return nil
+}
+
+// escapeMQTTTopic replaces the characters that have a special meaning in an MQTT topic.
+func escapeMQTTTopic(value string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(value)
+}
+
+// loadTLSConfig returns a TLS configuration that trusts the CA certificates in the file.
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Clean up any resources on exit
+func (p *MQTTPublisher) Cleanup() {
+	if p.client != nil {
+		p.client.disconnect()
+	}
+}
+
+// mqttV3Client is an mqttClient for MQTT 3.1 and 3.1.1.
+type mqttV3Client struct {
+	client mqtt.Client
+}
+
+// connectMQTTv3 connects to the first broker that accepts the connection, using the protocol level.
+func connectMQTTv3(settings mqttSettings, protocolLevel uint) (mqttClient, error) {
+	opts := mqtt.NewClientOptions()
+	for _, broker := range settings.brokers {
+		opts.AddBroker(broker)
+	}
+	opts.SetClientID(settings.clientID)
+	opts.SetProtocolVersion(protocolLevel)
+	opts.SetUsername(settings.username)
+	opts.SetPassword(settings.password)
+	opts.SetConnectTimeout(settings.timeout)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		log.Printf("WARNING: MQTTPublisher: Connection to the broker lost: %v", err)
+	})
+	if settings.tlsConfig != nil {
+		opts.SetTLSConfig(settings.tlsConfig)
+	}
+
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(settings.timeout) {
+		return nil, fmt.Errorf("timed out connecting to %v", settings.brokers)
+	}
+	if err := token.Error(); err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %v", settings.brokers, err)
+	}
+
+	return &mqttV3Client{client: client}, nil
+}
+
+func (c *mqttV3Client) publish(topic string, qos byte, retained bool, payload string, timeout time.Duration) error {
+	token := c.client.Publish(topic, qos, retained, payload)
+	if !token.WaitTimeout(timeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+
+	return token.Error()
+}
+
+func (c *mqttV3Client) disconnect() {
+	c.client.Disconnect(mqttDisconnectQuiesceMs)
+}
@@ -0,0 +1,122 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// The keep-alive period of MQTT 5 connections, in seconds.
+const mqttKeepAlive = 30
+
+// The MQTT 5 payload format indicator of a UTF-8 payload.
+const mqttPayloadFormatUTF8 byte = 1
+
+// mqttV5Client is an mqttClient for MQTT 5. Readings are published with a content type of application/json.
+type mqttV5Client struct {
+	manager *autopaho.ConnectionManager
+}
+
+// connectMQTTv5 connects to the first broker that accepts the connection. The connection manager reconnects,
+// trying each broker in turn, if the connection is lost.
+func connectMQTTv5(settings mqttSettings) (mqttClient, error) {
+	brokerURLs := make([]*url.URL, 0, len(settings.brokers))
+	for _, broker := range settings.brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker URL %s: %v", broker, err)
+		}
+		brokerURLs = append(brokerURLs, u)
+	}
+
+	cfg := autopaho.ClientConfig{
+		BrokerUrls:     brokerURLs,
+		TlsCfg:         settings.tlsConfig,
+		KeepAlive:      mqttKeepAlive,
+		ConnectTimeout: settings.timeout,
+		OnConnectError: func(err error) {
+			log.Printf("WARNING: MQTTPublisher: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: settings.clientID,
+			OnClientError: func(err error) {
+				log.Printf("WARNING: MQTTPublisher: Connection to the broker lost: %v", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				log.Printf("WARNING: MQTTPublisher: Disconnected by the broker: reason code %d", d.ReasonCode)
+			},
+		},
+	}
+	if settings.username != "" || settings.password != "" {
+		cfg.SetUsernamePassword(settings.username, []byte(settings.password))
+	}
+
+	manager, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %v", settings.brokers, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), settings.timeout)
+	defer cancel()
+	if err := manager.AwaitConnection(ctx); err != nil {
+		manager.Disconnect(context.Background()) // Stop trying to connect.
+		return nil, fmt.Errorf("timed out connecting to %v", settings.brokers)
+	}
+
+	return &mqttV5Client{manager: manager}, nil
+}
+
+func (c *mqttV5Client) publish(topic string, qos byte, retained bool, payload string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	format := mqttPayloadFormatUTF8
+	resp, err := c.manager.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: []byte(payload),
+		Properties: &paho.PublishProperties{
+			ContentType:   "application/json",
+			PayloadFormat: &format,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Reason codes of 0x80 and above are failures.
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		return fmt.Errorf("broker rejected the message for %s: reason code %d", topic, resp.ReasonCode)
+	}
+
+	return nil
+}
+
+func (c *mqttV5Client) disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), mqttDisconnectQuiesceMs*time.Millisecond)
+	defer cancel()
+
+	if err := c.manager.Disconnect(ctx); err != nil {
+		log.Printf("WARNING: MQTTPublisher: Failed to disconnect cleanly: %v", err)
+	}
+}
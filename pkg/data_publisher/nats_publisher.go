@@ -0,0 +1,238 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Configuration items for the NATSPublisher.
+const (
+	natsServersConfigItem     = "nats-servers"          // Comma-separated server URLs, e.g. nats://localhost:4222.
+	natsSubjectConfigItem     = "nats-subject-template" // Template for the subject of each reading. See topicTemplate.
+	natsStreamConfigItem      = "nats-stream"           // JetStream stream that must exist and capture the subjects. Optional.
+	natsCredsFileConfigItem   = "nats-creds-file"       // User credentials file. Optional.
+	natsTimeoutConfigItem     = "nats-timeout"          // Seconds to wait to connect, and for each message to be acknowledged.
+	natsMaxInFlightConfigItem = "nats-max-in-flight"    // Messages that can be waiting for acknowledgement before PublishData blocks.
+)
+
+// Defaults used if the configuration file does not set the NATSPublisher items.
+const (
+	defaultNATSSubject     = "carbon.{zone}"
+	defaultNATSTimeout     = "30"
+	defaultNATSMaxInFlight = "1000"
+)
+
+// Environment variable that holds the authentication token. Optional.
+const natsTokenEnvVar = "NATS_TOKEN"
+
+// How long Cleanup waits for messages in flight to be acknowledged.
+const natsFlushTimeout = 15 * time.Second
+
+// natsConfigItems returns the configuration items used by the NATSPublisher.
+func natsConfigItems() []config.Item {
+	return []config.Item{
+		{Key: natsServersConfigItem, Kind: config.KindList, RequiredIf: config.When("data-publisher", "nats-publisher")},
+		{Key: natsSubjectConfigItem, Kind: config.KindString, Default: defaultNATSSubject, Check: func(value string) error {
+			_, err := newTopicTemplate(value, escapeNATSSubject)
+			return err
+		}},
+		{Key: natsStreamConfigItem, Kind: config.KindString},
+		{Key: natsCredsFileConfigItem, Kind: config.KindString},
+		{Key: natsTimeoutConfigItem, Kind: config.KindInt, Default: defaultNATSTimeout, Check: config.AtLeast(1)},
+		{Key: natsMaxInFlightConfigItem, Kind: config.KindInt, Default: defaultNATSMaxInFlight, Check: config.AtLeast(1)},
+	}
+}
+
+// NATSPublisher is an implementation of the IDataPublisher that publishes readings to NATS JetStream. The subject is
+// built from the reading by a template. Each message has a Nats-Msg-Id of the zone and the reading's datetime, so
+// JetStream drops a reading that is published twice within the stream's duplicate window, e.g. after a restart.
+// Messages are published asynchronously and a DeliveryReport is sent when JetStream acknowledges each one.
+type NATSPublisher struct {
+	reports  chan DeliveryReport
+	conn     *nats.Conn
+	js       nats.JetStreamContext
+	subject  *topicTemplate
+	timeout  time.Duration
+	inFlight chan struct{}  // Holds a token for every message waiting for an acknowledgement.
+	closing  chan struct{}  // Closed by Cleanup so messages that have not been acknowledged are reported as failed.
+	acks     sync.WaitGroup // Goroutines waiting for an acknowledgement.
+}
+
+// Initialise reads the settings from the configuration file and connects to the servers.
+func (p *NATSPublisher) Initialise() {
+	appConfig := config.App()
+
+	servers := appConfig.List(natsServersConfigItem)
+	if len(servers) == 0 {
+		log.Fatalf("NATSPublisher::Initialise(): %s is not set", natsServersConfigItem)
+	}
+
+	var err error
+	p.subject, err = newTopicTemplate(appConfig.String(natsSubjectConfigItem), escapeNATSSubject)
+	if err != nil {
+		log.Fatalf("NATSPublisher::Initialise(): %v", err)
+	}
+	p.timeout = time.Duration(appConfig.Int(natsTimeoutConfigItem)) * time.Second
+	maxInFlight := appConfig.Int(natsMaxInFlightConfigItem)
+
+	opts := []nats.Option{
+		nats.Name("carbon-intensity"),
+		nats.Timeout(p.timeout),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("WARNING: NATSPublisher: Disconnected: %v", err)
+		}),
+	}
+	if credsFile := appConfig.String(natsCredsFileConfigItem); credsFile != "" {
+		opts = append(opts, nats.UserCredentials(credsFile))
+	}
+	if token := os.Getenv(natsTokenEnvVar); token != "" {
+		opts = append(opts, nats.Token(token))
+	}
+
+	p.conn, err = nats.Connect(strings.Join(servers, ","), opts...)
+	if err != nil {
+		log.Fatalf("NATSPublisher::Initialise(): Failed to connect to %v: %v", servers, err)
+	}
+
+	// Allow more pending acknowledgements than messages in flight, so PublishAsync never stalls.
+	p.js, err = p.conn.JetStream(nats.PublishAsyncMaxPending(maxInFlight + 1))
+	if err != nil {
+		log.Fatalf("NATSPublisher::Initialise(): Failed to use JetStream: %v", err)
+	}
+
+	if stream := appConfig.String(natsStreamConfigItem); stream != "" {
+		if _, err := p.js.StreamInfo(stream); err != nil {
+			log.Fatalf("NATSPublisher::Initialise(): Failed to find stream %s: %v", stream, err)
+		}
+	}
+
+	p.inFlight = make(chan struct{}, maxInFlight)
+	p.closing = make(chan struct{})
+
+	log.Printf("NATSPublisher connected to %s: subject=%s", p.conn.ConnectedUrl(), p.subject.template)
+}
+
+// Assign the channel that delivery reports are sent on.
+func (p *NATSPublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+// PublishData publishes the reading to the subject built from it and returns without waiting for JetStream. It
+// blocks while the maximum number of messages are in flight. The outcome is sent as a DeliveryReport.
+func (p *NATSPublisher) PublishData(key string, data string, opaque interface{}) error {
+	fmt.Printf("NATSPublisher::PublishData()\n")
+
+	if p.js == nil {
+		return errors.New("NATSPublisher is not initialised")
+	}
+
+	subject, err := p.subject.expand(key, data)
+	if err != nil {
+		return err
+	}
+
+	var pubOpts []nats.PubOpt
+	if id := natsMsgID(key, data); id != "" {
+		pubOpts = append(pubOpts, nats.MsgId(id))
+	} else {
+		log.Printf("WARNING: NATSPublisher: Reading for %s has no datetime, so it cannot be deduplicated", key)
+	}
+
+	p.inFlight <- struct{}{}
+	future, err := p.js.PublishAsync(subject, []byte(data), pubOpts...)
+	if err != nil {
+		<-p.inFlight
+		return err
+	}
+
+	p.acks.Add(1)
+	go p.awaitAck(future, subject, key, opaque)
+
+	return nil
+}
+
+// awaitAck waits for JetStream to acknowledge a message and reports its delivery.
+func (p *NATSPublisher) awaitAck(future nats.PubAckFuture, subject string, key string, opaque interface{}) {
+	defer p.acks.Done()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case ack := <-future.Ok():
+		if ack.Duplicate {
+			fmt.Printf("Duplicate event dropped by stream %s: key = %-10s\n", ack.Stream, key)
+		} else {
+			fmt.Printf("Produced event to subject %s: key = %-10s\n", subject, key)
+		}
+	case err = <-future.Err():
+	case <-timer.C:
+		err = fmt.Errorf("no acknowledgement from JetStream within %v", p.timeout)
+	case <-p.closing:
+		err = errors.New("no acknowledgement from JetStream before shutdown")
+	}
+
+	<-p.inFlight
+	report(p.reports, key, opaque, err)
+}
+
+// natsMsgID returns the message ID used to deduplicate a reading: the zone and the datetime of the reading.
+// Returns an empty string if the reading has no datetime.
+func natsMsgID(key string, data string) string {
+	var reading struct {
+		Datetime string `json:"datetime"`
+	}
+	if err := json.Unmarshal([]byte(data), &reading); err != nil || reading.Datetime == "" {
+		return ""
+	}
+
+	return key + "@" + reading.Datetime
+}
+
+// escapeNATSSubject replaces the characters that separate tokens or are wildcards in a NATS subject.
+func escapeNATSSubject(value string) string {
+	return strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_").Replace(value)
+}
+
+// Clean up any resources on exit. Waits for the messages in flight to be acknowledged, then closes the connection.
+func (p *NATSPublisher) Cleanup() {
+	if p.conn == nil {
+		return
+	}
+
+	select {
+	case <-p.js.PublishAsyncComplete():
+	case <-time.After(natsFlushTimeout):
+		log.Printf("WARNING: NATSPublisher: %d messages were not acknowledged within %v", len(p.inFlight), natsFlushTimeout)
+	}
+
+	close(p.closing)
+	p.acks.Wait()
+	p.conn.Close()
+}
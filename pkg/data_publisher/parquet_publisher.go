@@ -0,0 +1,307 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Configuration items for the ParquetPublisher.
+const (
+	parquetDirConfigItem           = "parquet-publisher-dir"            // Root directory of the partitioned table.
+	parquetBatchSizeConfigItem     = "parquet-publisher-batch-size"     // Readings buffered before they are written.
+	parquetFlushIntervalConfigItem = "parquet-publisher-flush-interval" // Longest number of seconds a reading is buffered.
+	parquetCompressionConfigItem   = "parquet-publisher-compression"    // Compression codec for the column data.
+)
+
+// Defaults used if the configuration file does not set the ParquetPublisher items.
+const (
+	defaultParquetDir           = "./data/parquet"
+	defaultParquetBatchSize     = "1000"
+	defaultParquetFlushInterval = "60"
+	defaultParquetCompression   = "snappy"
+)
+
+// The compression codecs that can be configured.
+var parquetCompressionCodecs = map[string]parquet.CompressionCodec{
+	"uncompressed": parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy":       parquet.CompressionCodec_SNAPPY,
+	"gzip":         parquet.CompressionCodec_GZIP,
+	"zstd":         parquet.CompressionCodec_ZSTD,
+}
+
+// parquetConfigItems returns the configuration items used by the ParquetPublisher.
+func parquetConfigItems() []config.Item {
+	codecs := make([]string, 0, len(parquetCompressionCodecs))
+	for k := range parquetCompressionCodecs {
+		codecs = append(codecs, k)
+	}
+	sort.Strings(codecs)
+
+	return []config.Item{
+		{Key: parquetDirConfigItem, Kind: config.KindString, Default: defaultParquetDir},
+		{Key: parquetBatchSizeConfigItem, Kind: config.KindInt, Default: defaultParquetBatchSize, Check: config.AtLeast(1)},
+		{Key: parquetFlushIntervalConfigItem, Kind: config.KindInt, Default: defaultParquetFlushInterval, Check: config.AtLeast(1)},
+		{Key: parquetCompressionConfigItem, Kind: config.KindString, Default: defaultParquetCompression, Options: codecs},
+	}
+}
+
+// parquetReading is a row of the table. The columns and their types match config/co2signal-trino-schema.json.
+// country_code and the date are not stored in the file because they are the partition columns.
+type parquetReading struct {
+	CountryName          string   `parquet:"name=country_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ZoneName             string   `parquet:"name=zone_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Status               string   `parquet:"name=status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Datetime             int64    `parquet:"name=datetime, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	CarbonIntensity      float64  `parquet:"name=carbon_intensity, type=DOUBLE"`
+	FosselFuelPercentage *float64 `parquet:"name=fossel_fuel_percentage, type=DOUBLE, repetitiontype=OPTIONAL"`
+	UnitName             string   `parquet:"name=unit_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	UnitValue            string   `parquet:"name=unit_value, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// The fields of a reading's JSON payload that are written to the table.
+type parquetPayload struct {
+	CountryCode          string   `json:"country_code"`
+	CountryName          string   `json:"country_name"`
+	ZoneName             string   `json:"zone_name"`
+	Status               string   `json:"status"`
+	Datetime             string   `json:"datetime"`
+	CarbonIntensity      float64  `json:"carbon_intensity"`
+	FosselFuelPercentage *float64 `json:"fossel_fuel_percentage"` // null if the data source does not know it.
+	UnitName             string   `json:"unit_name"`
+	UnitValue            string   `json:"unit_value"`
+}
+
+// parquetPartition identifies the directory a reading is written to.
+type parquetPartition struct {
+	countryCode string
+	date        string // The UTC date of the reading, YYYY-MM-DD.
+}
+
+// A reading waiting to be written, with what is needed to report its delivery.
+type bufferedReading struct {
+	row    parquetReading
+	key    string
+	opaque interface{}
+}
+
+// ParquetPublisher is an implementation of the IDataPublisher that buffers readings and writes them as Parquet files
+// under Hive-style partitions: <dir>/country_code=<zone>/date=<YYYY-MM-DD>/part-<id>.parquet, so a Hive or Trino
+// external table can query them directly. The buffer is written when it holds batch-size readings, when the flush
+// interval passes and on Cleanup. Delivery reports are sent once a reading's file is complete.
+type ParquetPublisher struct {
+	mutex         sync.Mutex
+	reports       chan DeliveryReport
+	dir           string
+	batchSize     int
+	flushInterval time.Duration
+	compression   parquet.CompressionCodec
+	buffer        map[parquetPartition][]bufferedReading
+	buffered      int
+	files         int // Number of files written, used to make the file names unique.
+	stop          chan struct{}
+	stopped       chan struct{}
+}
+
+// Initialise reads the settings from the configuration file and starts the timer that flushes the buffer.
+func (p *ParquetPublisher) Initialise() {
+	appConfig := config.App()
+
+	p.dir = appConfig.String(parquetDirConfigItem)
+	p.batchSize = appConfig.Int(parquetBatchSizeConfigItem)
+	p.flushInterval = time.Duration(appConfig.Int(parquetFlushIntervalConfigItem)) * time.Second
+	p.compression = parquetCompressionCodecs[appConfig.String(parquetCompressionConfigItem)]
+	p.buffer = make(map[parquetPartition][]bufferedReading)
+	p.stop = make(chan struct{})
+	p.stopped = make(chan struct{})
+
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		log.Fatalf("ParquetPublisher::Initialise(): Failed to create %s: %v", p.dir, err)
+	}
+
+	log.Printf("ParquetPublisher writing to %s: batch-size=%d flush-interval=%v compression=%s", p.dir,
+		p.batchSize, p.flushInterval, appConfig.String(parquetCompressionConfigItem))
+
+	go p.flushPeriodically()
+}
+
+// Assign the channel that delivery reports are sent on.
+func (p *ParquetPublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+// PublishData adds the reading to the buffer, writing the buffer if it is full. The data must be a JSON object with
+// a country_code and a datetime, which choose the partition.
+func (p *ParquetPublisher) PublishData(key string, data string, opaque interface{}) error {
+	fmt.Printf("ParquetPublisher::PublishData()\n")
+
+	var payload parquetPayload
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return fmt.Errorf("reading for %s is not valid JSON: %v", key, err)
+	}
+	if payload.CountryCode == "" {
+		return fmt.Errorf("reading for %s has no country_code", key)
+	}
+	datetime, err := time.Parse(time.RFC3339, payload.Datetime)
+	if err != nil {
+		return fmt.Errorf("reading for %s has an invalid datetime (%s): %v", key, payload.Datetime, err)
+	}
+	datetime = datetime.UTC()
+
+	partition := parquetPartition{countryCode: payload.CountryCode, date: datetime.Format("2006-01-02")}
+	row := parquetReading{
+		CountryName:          payload.CountryName,
+		ZoneName:             payload.ZoneName,
+		Status:               payload.Status,
+		Datetime:             datetime.UnixMilli(),
+		CarbonIntensity:      payload.CarbonIntensity,
+		FosselFuelPercentage: payload.FosselFuelPercentage,
+		UnitName:             payload.UnitName,
+		UnitValue:            payload.UnitValue,
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.buffer[partition] = append(p.buffer[partition], bufferedReading{row: row, key: key, opaque: opaque})
+	p.buffered++
+	if p.buffered >= p.batchSize {
+		p.flush()
+	}
+
+	return nil
+}
+
+// flushPeriodically writes the buffer every flush interval until Cleanup is called.
+func (p *ParquetPublisher) flushPeriodically() {
+	defer close(p.stopped)
+
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.mutex.Lock()
+			p.flush()
+			p.mutex.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// flush writes a file for each partition in the buffer and reports the delivery of each reading. The caller must
+// hold the mutex.
+func (p *ParquetPublisher) flush() {
+	if p.buffered == 0 {
+		return
+	}
+
+	for partition, readings := range p.buffer {
+		err := p.writeFile(partition, readings)
+		if err != nil {
+			log.Printf("ERROR: ParquetPublisher: Failed to write %d readings for %s on %s: %v",
+				len(readings), partition.countryCode, partition.date, err)
+		}
+
+		for _, r := range readings {
+			report(p.reports, r.key, r.opaque, err)
+		}
+	}
+
+	p.buffer = make(map[parquetPartition][]bufferedReading)
+	p.buffered = 0
+}
+
+// writeFile writes the readings to a new file in the partition's directory. The file is written under a hidden
+// name, which Hive and Trino ignore, and renamed when it is complete.
+func (p *ParquetPublisher) writeFile(partition parquetPartition, readings []bufferedReading) error {
+	dir := filepath.Join(p.dir, "country_code="+partition.countryCode, "date="+partition.date)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	p.files++
+	name := "part-" + strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + strconv.Itoa(p.files) + ".parquet"
+	path := filepath.Join(dir, name)
+	tmpPath := filepath.Join(dir, "."+name+".tmp")
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = writeRows(file, p.compression, readings)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	log.Printf("ParquetPublisher: Wrote %d readings to %s", len(readings), path)
+	return nil
+}
+
+// writeRows writes the readings to the file in Parquet format.
+func writeRows(file *os.File, compression parquet.CompressionCodec, readings []bufferedReading) error {
+	pw, err := writer.NewParquetWriterFromWriter(file, new(parquetReading), 1)
+	if err != nil {
+		return err
+	}
+	pw.CompressionType = compression
+
+	for _, r := range readings {
+		if err := pw.Write(r.row); err != nil {
+			return err
+		}
+	}
+
+	return pw.WriteStop()
+}
+
+// Clean up any resources on exit. Stops the flush timer and writes any buffered readings.
+func (p *ParquetPublisher) Cleanup() {
+	if p.stop == nil {
+		return
+	}
+
+	close(p.stop)
+	<-p.stopped
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.flush()
+}
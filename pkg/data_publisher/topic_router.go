@@ -0,0 +1,105 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The fields of a reading a route can match on.
+const (
+	routeByZone    = "zone"    // Matches the zone key, e.g. zone:US-*:co2signal.us
+	routeByCountry = "country" // Matches the country name, e.g. country:France:co2signal.eu
+)
+
+// topicRoute sends readings that match a glob pattern to a topic.
+type topicRoute struct {
+	field   string
+	pattern string
+	topic   string
+}
+
+// topicRouter chooses the topic each reading is published to. Routes are tried in order and the first match
+// wins. Readings that match no route go to the default topic.
+type topicRouter struct {
+	defaultTopic string
+	routes       []topicRoute
+}
+
+// newTopicRouter parses a comma-separated list of routes. Each route has the form field:pattern:topic, where
+// field is "zone" or "country" and pattern is a glob.
+func newTopicRouter(defaultTopic string, routes string) (*topicRouter, error) {
+	router := &topicRouter{defaultTopic: defaultTopic}
+
+	for _, route := range strings.Split(routes, ",") {
+		route = strings.TrimSpace(route)
+		if route == "" {
+			continue
+		}
+
+		parts := strings.Split(route, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid topic route (%s). Routes have the form field:pattern:topic", route)
+		}
+
+		r := topicRoute{field: strings.TrimSpace(parts[0]), pattern: strings.TrimSpace(parts[1]), topic: strings.TrimSpace(parts[2])}
+		if r.field != routeByZone && r.field != routeByCountry {
+			return nil, fmt.Errorf("invalid topic route (%s). Field must be %s or %s", route, routeByZone, routeByCountry)
+		}
+		if _, err := path.Match(r.pattern, ""); err != nil || r.pattern == "" {
+			return nil, fmt.Errorf("invalid topic route (%s). Bad pattern", route)
+		}
+		if r.topic == "" {
+			return nil, fmt.Errorf("invalid topic route (%s). No topic", route)
+		}
+
+		router.routes = append(router.routes, r)
+	}
+
+	return router, nil
+}
+
+// topicFor returns the topic for a reading. The key is the zone, and the country name is read from the data.
+func (t *topicRouter) topicFor(key string, data string) string {
+	var country string
+	for _, r := range t.routes {
+		value := key
+		if r.field == routeByCountry {
+			if country == "" {
+				country = countryName(data)
+			}
+			value = country
+		}
+
+		if ok, _ := path.Match(r.pattern, value); ok {
+			return r.topic
+		}
+	}
+
+	return t.defaultTopic
+}
+
+// countryName extracts the country name from a reading. Returns "" if the reading does not have one.
+func countryName(data string) string {
+	var reading struct {
+		Country string `json:"country_name"`
+	}
+	json.Unmarshal([]byte(data), &reading)
+
+	return reading.Country
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Placeholders in a topic template are a field name in braces, e.g. {country_code}.
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Placeholders that are not fields of the reading.
+const (
+	placeholderKey  = "key"  // The reading's key.
+	placeholderZone = "zone" // The zone key, which is the same as the reading's key.
+)
+
+// topicTemplate builds the topic or subject a reading is published to from its fields. A placeholder such as
+// {country_name} is replaced by that field of the reading's JSON, and {zone} and {key} by the reading's key, so
+// "carbon/{country_code}/{zone}" becomes "carbon/AUS-NSW/AUS-NSW".
+type topicTemplate struct {
+	template string
+	escape   func(string) string // Makes a value safe to use as part of a topic.
+}
+
+// newTopicTemplate checks the template and returns a topicTemplate. Values are passed through escape.
+func newTopicTemplate(template string, escape func(string) string) (*topicTemplate, error) {
+	if template == "" {
+		return nil, fmt.Errorf("empty topic template")
+	}
+
+	// Remove the valid placeholders. Any brace that is left is unbalanced.
+	rest := templatePlaceholder.ReplaceAllStringFunc(template, func(p string) string {
+		if strings.TrimSpace(p[1:len(p)-1]) == "" {
+			return "{"
+		}
+		return ""
+	})
+	if strings.ContainsAny(rest, "{}") {
+		return nil, fmt.Errorf("invalid topic template (%s). Placeholders have the form {field}", template)
+	}
+
+	return &topicTemplate{template: template, escape: escape}, nil
+}
+
+// expand returns the topic for a reading. It returns an error if the reading does not have a field the template
+// uses.
+func (t *topicTemplate) expand(key string, data string) (string, error) {
+	var fields map[string]interface{}
+	if strings.Contains(t.template, "{") {
+		if err := json.Unmarshal([]byte(data), &fields); err != nil {
+			return "", fmt.Errorf("reading for %s is not a JSON object: %v", key, err)
+		}
+	}
+
+	var missing []string
+	topic := templatePlaceholder.ReplaceAllStringFunc(t.template, func(p string) string {
+		name := strings.TrimSpace(p[1 : len(p)-1])
+
+		var value string
+		if name == placeholderKey || name == placeholderZone {
+			value = key
+		} else if v, ok := fields[name]; ok && v != nil {
+			value = fmt.Sprint(v)
+		} else {
+			missing = append(missing, name)
+		}
+
+		return t.escape(value)
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("reading for %s has no %s for the topic template", key, strings.Join(missing, ", "))
+	}
+
+	return topic, nil
+}
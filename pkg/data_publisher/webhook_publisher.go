@@ -0,0 +1,413 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/retry"
+)
+
+// Configuration items for the WebhookPublisher.
+const (
+	webhookURLsConfigItem           = "webhook-urls"             // Comma-separated URLs every reading is posted to.
+	webhookHeadersConfigItem        = "webhook-headers"          // Comma-separated Name:value headers added to each request.
+	webhookBatchSizeConfigItem      = "webhook-batch-size"       // Readings per request. 1 posts each reading as an object.
+	webhookFlushIntervalConfigItem  = "webhook-flush-interval"   // Longest number of seconds a reading waits for a batch to fill.
+	webhookTimeoutConfigItem        = "webhook-timeout"          // Deadline in seconds for each request.
+	webhookMaxRetriesConfigItem     = "webhook-max-retries"      // Number of times a failed request is retried.
+	webhookMaxBackoffConfigItem     = "webhook-max-backoff"      // Longest number of seconds to wait between retries.
+	webhookDeadLetterFileConfigItem = "webhook-dead-letter-file" // File that readings are written to when they cannot be delivered.
+	webhookCleanupTimeoutConfigItem = "webhook-cleanup-timeout"  // Longest number of seconds Cleanup waits for queued readings to be sent.
+)
+
+// Defaults used if the configuration file does not set the WebhookPublisher items.
+const (
+	defaultWebhookBatchSize      = "1"
+	defaultWebhookFlushInterval  = "10"
+	defaultWebhookTimeout        = "10"
+	defaultWebhookMaxRetries     = "5"
+	defaultWebhookMaxBackoff     = "60"
+	defaultWebhookDeadLetterFile = "./data/webhook-dead-letter.ndjson"
+	defaultWebhookCleanupTimeout = "8"
+)
+
+// Environment variable that holds the key requests are signed with. Requests are not signed if it is not set.
+const webhookSecretEnvVar = "WEBHOOK_SIGNING_SECRET"
+
+// Headers that carry the request signature. The signature is "sha256=" followed by the hex HMAC-SHA256 of
+// "<timestamp>.<body>", so a receiver can reject a request that has been altered or replayed.
+const (
+	webhookSignatureHeader = "X-Signature-256"
+	webhookTimestampHeader = "X-Signature-Timestamp"
+)
+
+// The number of readings that can be waiting to be sent before PublishData blocks.
+const webhookQueueSize = 1000
+
+// The wait before the first retry. It doubles on each subsequent retry up to the maximum backoff.
+const webhookBaseBackoff = time.Second
+
+// webhookConfigItems returns the configuration items used by the WebhookPublisher.
+func webhookConfigItems() []config.Item {
+	return []config.Item{
+		{Key: webhookURLsConfigItem, Kind: config.KindList, RequiredIf: config.When("data-publisher", "webhook-publisher")},
+		{Key: webhookHeadersConfigItem, Kind: config.KindList, Secret: true, Check: func(value string) error {
+			_, err := parseHeaders(config.SplitList(value))
+			return err
+		}},
+		{Key: webhookBatchSizeConfigItem, Kind: config.KindInt, Default: defaultWebhookBatchSize, Check: config.AtLeast(1)},
+		{Key: webhookFlushIntervalConfigItem, Kind: config.KindInt, Default: defaultWebhookFlushInterval, Check: config.AtLeast(1)},
+		{Key: webhookTimeoutConfigItem, Kind: config.KindInt, Default: defaultWebhookTimeout, Check: config.AtLeast(1)},
+		{Key: webhookMaxRetriesConfigItem, Kind: config.KindInt, Default: defaultWebhookMaxRetries, Check: config.AtLeast(0)},
+		{Key: webhookMaxBackoffConfigItem, Kind: config.KindInt, Default: defaultWebhookMaxBackoff, Check: config.AtLeast(1)},
+		{Key: webhookDeadLetterFileConfigItem, Kind: config.KindString, Default: defaultWebhookDeadLetterFile},
+		{Key: webhookCleanupTimeoutConfigItem, Kind: config.KindInt, Default: defaultWebhookCleanupTimeout, Check: config.AtLeast(1)},
+	}
+}
+
+// A reading waiting to be posted, with what is needed to report its delivery.
+type webhookMessage struct {
+	key    string
+	data   json.RawMessage
+	opaque interface{}
+}
+
+// An entry in the dead-letter file.
+type deadLetter struct {
+	Time    string          `json:"time"`
+	URL     string          `json:"url"`
+	Error   string          `json:"error"`
+	Key     string          `json:"key"`
+	Reading json.RawMessage `json:"reading"`
+}
+
+// errPermanent marks a delivery failure that retrying will not fix.
+var errPermanent = errors.New("permanent failure")
+
+// WebhookPublisher is an implementation of the IDataPublisher that POSTs readings as JSON to one or more URLs.
+// With a batch size of 1 each reading is posted as an object, otherwise readings are posted as an array. Requests
+// can be signed with HMAC-SHA256, and failed requests are retried with jittered exponential backoff. A reading
+// that cannot be delivered to a URL is written to the dead-letter file. Requests are sent by a background
+// goroutine so PublishData does not wait for the receivers.
+//
+// Delivery is at least once to each URL. A batch that fails on one URL is reported as failed for all of its
+// readings, even if the other URLs accepted it, so the checkpoint of their zones does not advance. The next time
+// the zones are read, including after a restart, the readings are posted again to every URL, including those
+// that already accepted them. The dead-letter file records which URL failed. Receivers should treat the key and
+// datetime of a reading as its identity and ignore readings they already have.
+type WebhookPublisher struct {
+	reports        chan DeliveryReport
+	urls           []string
+	headers        map[string]string
+	secret         []byte
+	batchSize      int
+	flushInterval  time.Duration
+	maxRetries     int
+	maxBackoff     time.Duration
+	deadLetterFile string
+	cleanupTimeout time.Duration // How long Cleanup waits for the queued readings to be sent before it aborts the requests.
+	client         http.Client
+	queue          chan webhookMessage
+	done           chan struct{}   // Closed when the sender has finished.
+	ctx            context.Context // Cancelled by Cleanup so the sender stops waiting to retry.
+	cancel         context.CancelFunc
+	requestCtx     context.Context // Cancelled if Cleanup times out, which aborts the request in progress.
+	abort          context.CancelFunc
+}
+
+// Initialise reads the settings from the configuration file and starts the goroutine that sends the requests.
+func (p *WebhookPublisher) Initialise() {
+	appConfig := config.App()
+
+	p.urls = appConfig.List(webhookURLsConfigItem)
+	if len(p.urls) == 0 {
+		log.Fatalf("WebhookPublisher::Initialise(): %s is not set", webhookURLsConfigItem)
+	}
+
+	var err error
+	p.headers, err = parseHeaders(appConfig.List(webhookHeadersConfigItem))
+	if err != nil {
+		log.Fatalf("WebhookPublisher::Initialise(): %v", err)
+	}
+
+	p.secret = []byte(os.Getenv(webhookSecretEnvVar))
+	p.batchSize = appConfig.Int(webhookBatchSizeConfigItem)
+	p.flushInterval = time.Duration(appConfig.Int(webhookFlushIntervalConfigItem)) * time.Second
+	p.client.Timeout = time.Duration(appConfig.Int(webhookTimeoutConfigItem)) * time.Second
+	p.maxRetries = appConfig.Int(webhookMaxRetriesConfigItem)
+	p.maxBackoff = time.Duration(appConfig.Int(webhookMaxBackoffConfigItem)) * time.Second
+	p.deadLetterFile = appConfig.String(webhookDeadLetterFileConfigItem)
+	p.cleanupTimeout = time.Duration(appConfig.Int(webhookCleanupTimeoutConfigItem)) * time.Second
+
+	p.queue = make(chan webhookMessage, webhookQueueSize)
+	p.done = make(chan struct{})
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.requestCtx, p.abort = context.WithCancel(context.Background())
+
+	log.Printf("WebhookPublisher posting to %v: batch-size=%d signed=%v", p.urls, p.batchSize, len(p.secret) > 0)
+
+	go p.run()
+}
+
+// Assign the channel that delivery reports are sent on.
+func (p *WebhookPublisher) SetDeliveryChannel(reports chan DeliveryReport) {
+	p.reports = reports
+}
+
+// PublishData queues the reading to be posted. The data must be valid JSON. It blocks if the queue is full.
+func (p *WebhookPublisher) PublishData(key string, data string, opaque interface{}) error {
+	fmt.Printf("WebhookPublisher::PublishData()\n")
+
+	if p.queue == nil {
+		return errors.New("WebhookPublisher is not initialised")
+	}
+	if !json.Valid([]byte(data)) {
+		return fmt.Errorf("reading for %s is not valid JSON", key)
+	}
+
+	p.queue <- webhookMessage{key: key, data: json.RawMessage(data), opaque: opaque}
+	return nil
+}
+
+// run collects the queued readings into batches and sends them until the queue is closed.
+func (p *WebhookPublisher) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.flushInterval)
+	defer ticker.Stop()
+
+	var batch []webhookMessage
+	for {
+		select {
+		case m, ok := <-p.queue:
+			if !ok {
+				p.send(batch)
+				return
+			}
+
+			batch = append(batch, m)
+			if len(batch) >= p.batchSize {
+				p.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			p.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send posts the batch to every URL and reports the delivery of each reading. A reading is only delivered if
+// every URL accepted it. If it is not, it is posted again to every URL later, so receivers can see it twice. See
+// WebhookPublisher.
+func (p *WebhookPublisher) send(batch []webhookMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := p.encode(batch)
+	if err != nil {
+		log.Printf("ERROR: WebhookPublisher: Failed to encode %d readings: %v", len(batch), err)
+	}
+
+	failed := err
+	for _, url := range p.urls {
+		if body == nil {
+			break
+		}
+
+		if err := p.post(url, body); err != nil {
+			log.Printf("ERROR: WebhookPublisher: Failed to deliver %d readings to %s: %v", len(batch), url, err)
+			p.writeDeadLetters(url, batch, err)
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+
+	for _, m := range batch {
+		report(p.reports, m.key, m.opaque, failed)
+	}
+}
+
+// encode returns the request body for the batch: the reading itself if the batch size is 1, otherwise an array.
+func (p *WebhookPublisher) encode(batch []webhookMessage) ([]byte, error) {
+	if p.batchSize == 1 {
+		return batch[0].data, nil
+	}
+
+	readings := make([]json.RawMessage, len(batch))
+	for i, m := range batch {
+		readings[i] = m.data
+	}
+
+	return json.Marshal(readings)
+}
+
+// post sends the body to the URL, retrying network errors, 429 and 5xx responses.
+func (p *WebhookPublisher) post(url string, body []byte) error {
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := p.postOnce(url, body)
+		if err == nil || errors.Is(err, errPermanent) || attempt >= p.maxRetries || p.ctx.Err() != nil {
+			// Do not retry while shutting down.
+			return err
+		}
+
+		delay := retry.Backoff(webhookBaseBackoff, p.maxBackoff, attempt)
+		if retryAfter > 0 {
+			if retryAfter > p.maxBackoff {
+				// The receiver wants us to wait longer than we are prepared to, so give up now.
+				return err
+			}
+			delay = retryAfter
+		}
+
+		log.Printf("WARNING: WebhookPublisher: Request to %s failed, retrying in %v: %v", url, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-p.ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// postOnce sends a single signed request. It returns the delay requested by any Retry-After header, and an error
+// wrapping errPermanent if the request should not be retried.
+func (p *WebhookPublisher) postOnce(url string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(p.requestCtx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	if len(p.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, sign(p.secret, timestamp, body))
+	}
+
+	response, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	respBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 200))
+
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return 0, nil
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		return retry.ParseRetryAfter(response.Header.Get("Retry-After")), fmt.Errorf("status %d: %s", response.StatusCode, respBody)
+	default:
+		return 0, fmt.Errorf("%w: status %d: %s", errPermanent, response.StatusCode, respBody)
+	}
+}
+
+// sign returns the signature of a request body sent at the timestamp.
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeDeadLetters appends the readings that could not be delivered to the URL to the dead-letter file.
+func (p *WebhookPublisher) writeDeadLetters(url string, batch []webhookMessage, cause error) {
+	if err := os.MkdirAll(filepath.Dir(p.deadLetterFile), 0755); err != nil {
+		log.Printf("ERROR: WebhookPublisher: Failed to create the dead-letter directory: %v", err)
+		return
+	}
+
+	file, err := os.OpenFile(p.deadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("ERROR: WebhookPublisher: Failed to open the dead-letter file: %v", err)
+		return
+	}
+	defer file.Close()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	encoder := json.NewEncoder(file)
+	for _, m := range batch {
+		entry := deadLetter{Time: now, URL: url, Error: cause.Error(), Key: m.key, Reading: m.data}
+		if err := encoder.Encode(entry); err != nil {
+			log.Printf("ERROR: WebhookPublisher: Failed to write to the dead-letter file: %v", err)
+			return
+		}
+	}
+}
+
+// parseHeaders converts Name:value pairs to a map of headers.
+func parseHeaders(pairs []string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for i, pair := range pairs {
+		name, value, ok := strings.Cut(pair, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			// The header is not shown because it may hold a credential.
+			return nil, fmt.Errorf("header %d is invalid. Headers have the form Name:value", i+1)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+
+	return headers, nil
+}
+
+// Clean up any resources on exit. Readings that are still queued are sent once, without retries, so shutdown
+// is not held up by a receiver that is down. If they are not sent within webhook-cleanup-timeout the requests
+// are aborted, and the readings are written to the dead-letter file and reported as not delivered. The default
+// timeout leaves time for this within the Kubernetes termination grace period after the reader has stopped.
+func (p *WebhookPublisher) Cleanup() {
+	if p.queue == nil {
+		return
+	}
+
+	p.cancel()
+	close(p.queue)
+
+	timer := time.NewTimer(p.cleanupTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+	case <-timer.C:
+		log.Printf("ERROR: WebhookPublisher: Readings were not sent within %v. The requests are aborted.", p.cleanupTimeout)
+		p.abort()
+		<-p.done
+	}
+	p.abort()
+}
@@ -0,0 +1,311 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_publisher
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is a test server that records the requests it is sent and answers them with a list of status
+// codes. The last status code answers every request after it.
+type webhookReceiver struct {
+	*httptest.Server
+	mutex      sync.Mutex
+	statuses   []int
+	retryAfter string
+	requests   []*http.Request
+	bodies     [][]byte
+}
+
+func newWebhookReceiver(t *testing.T, retryAfter string, statuses ...int) *webhookReceiver {
+	t.Helper()
+
+	r := &webhookReceiver{statuses: statuses, retryAfter: retryAfter}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		r.mutex.Lock()
+		n := len(r.requests)
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		r.mutex.Unlock()
+
+		status := r.statuses[len(r.statuses)-1]
+		if n < len(r.statuses) {
+			status = r.statuses[n]
+		}
+		if r.retryAfter != "" && status != http.StatusOK {
+			w.Header().Set("Retry-After", r.retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+
+	return r
+}
+
+// received returns the number of requests the receiver has been sent.
+func (r *webhookReceiver) received() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.requests)
+}
+
+// newTestWebhookPublisher returns a publisher for the URLs that is ready to send, without reading the
+// configuration or starting the sender. Retries wait at most 100ms.
+func newTestWebhookPublisher(t *testing.T, urls ...string) *WebhookPublisher {
+	p := &WebhookPublisher{
+		reports:        make(chan DeliveryReport, 10),
+		urls:           urls,
+		batchSize:      1,
+		flushInterval:  time.Hour,
+		maxRetries:     3,
+		maxBackoff:     100 * time.Millisecond,
+		deadLetterFile: filepath.Join(t.TempDir(), "dead-letter.ndjson"),
+		cleanupTimeout: 5 * time.Second,
+		queue:          make(chan webhookMessage, webhookQueueSize),
+		done:           make(chan struct{}),
+	}
+	p.client.Timeout = 5 * time.Second
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.requestCtx, p.abort = context.WithCancel(context.Background())
+	t.Cleanup(p.abort)
+
+	return p
+}
+
+func TestWebhookPost(t *testing.T) {
+	tests := []struct {
+		name          string
+		statuses      []int
+		retryAfter    string
+		wantRequests  int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{name: "accepted", statuses: []int{200}, wantRequests: 1},
+		{name: "5xx then 2xx", statuses: []int{503, 200}, wantRequests: 2},
+		{name: "429 then 2xx", statuses: []int{429, 200}, wantRequests: 2},
+		{name: "4xx is not retried", statuses: []int{400}, wantRequests: 1, wantErr: true, wantPermanent: true},
+		{name: "retries run out", statuses: []int{500}, wantRequests: 4, wantErr: true},
+		{
+			// The receiver asks for a 1s wait, which is longer than the 100ms maximum backoff.
+			name: "Retry-After above the maximum backoff", statuses: []int{503}, retryAfter: "1",
+			wantRequests: 1, wantErr: true,
+		},
+		{name: "Retry-After within the maximum backoff", statuses: []int{503, 200}, retryAfter: "0", wantRequests: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := newWebhookReceiver(t, tt.retryAfter, tt.statuses...)
+			p := newTestWebhookPublisher(t, receiver.URL)
+
+			err := p.post(receiver.URL, []byte(`{"key":"DE"}`))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("post() error = %v, want error %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errPermanent) != tt.wantPermanent {
+				t.Errorf("post() error = %v, want permanent %v", err, tt.wantPermanent)
+			}
+			if n := receiver.received(); n != tt.wantRequests {
+				t.Errorf("receiver got %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	receiver := newWebhookReceiver(t, "", 200)
+	p := newTestWebhookPublisher(t, receiver.URL)
+	p.secret = []byte("signing-secret")
+	p.headers = map[string]string{"Authorization": "Bearer abc123"}
+
+	body := []byte(`{"key":"DE","carbon_intensity":350}`)
+	if err := p.post(receiver.URL, body); err != nil {
+		t.Fatalf("post() error = %v", err)
+	}
+
+	req := receiver.requests[0]
+	timestamp := req.Header.Get(webhookTimestampHeader)
+	if timestamp == "" {
+		t.Fatalf("no %s header", webhookTimestampHeader)
+	}
+
+	mac := hmac.New(sha256.New, []byte("signing-secret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := req.Header.Get(webhookSignatureHeader); got != want {
+		t.Errorf("%s = %s, want %s", webhookSignatureHeader, got, want)
+	}
+	if got := req.Header.Get("Authorization"); got != "Bearer abc123" {
+		t.Errorf("Authorization = %s, want Bearer abc123", got)
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %s, want application/json", got)
+	}
+}
+
+func TestWebhookUnsigned(t *testing.T) {
+	receiver := newWebhookReceiver(t, "", 200)
+	p := newTestWebhookPublisher(t, receiver.URL)
+
+	if err := p.post(receiver.URL, []byte(`{}`)); err != nil {
+		t.Fatalf("post() error = %v", err)
+	}
+	if got := receiver.requests[0].Header.Get(webhookSignatureHeader); got != "" {
+		t.Errorf("%s = %s, want no signature", webhookSignatureHeader, got)
+	}
+}
+
+// TestWebhookBatch publishes two readings with a batch size of 2, so they are posted as one array when the
+// publisher is cleaned up.
+func TestWebhookBatch(t *testing.T) {
+	receiver := newWebhookReceiver(t, "", 200)
+	p := newTestWebhookPublisher(t, receiver.URL)
+	p.batchSize = 2
+	go p.run()
+
+	for _, key := range []string{"DE", "FR", "GB"} {
+		if err := p.PublishData(key, `{"key":"`+key+`"}`, key); err != nil {
+			t.Fatalf("PublishData(%s) error = %v", key, err)
+		}
+	}
+	p.Cleanup()
+
+	if n := receiver.received(); n != 2 {
+		t.Fatalf("receiver got %d requests, want 2", n)
+	}
+	if got := string(receiver.bodies[0]); got != `[{"key":"DE"},{"key":"FR"}]` {
+		t.Errorf("first batch = %s", got)
+	}
+	if got := string(receiver.bodies[1]); got != `[{"key":"GB"}]` {
+		t.Errorf("second batch = %s", got)
+	}
+
+	close(p.reports)
+	for r := range p.reports {
+		if r.Err != nil || r.Opaque != r.Key {
+			t.Errorf("report for %s: opaque = %v, error = %v", r.Key, r.Opaque, r.Err)
+		}
+	}
+}
+
+// TestWebhookDeadLetters checks that a batch one URL rejects is written to the dead-letter file for that URL and
+// reported as not delivered, even though the other URL accepted it.
+func TestWebhookDeadLetters(t *testing.T) {
+	accepting := newWebhookReceiver(t, "", 200)
+	rejecting := newWebhookReceiver(t, "", 400)
+	p := newTestWebhookPublisher(t, accepting.URL, rejecting.URL)
+	p.batchSize = 2
+
+	p.send([]webhookMessage{
+		{key: "DE", data: json.RawMessage(`{"key":"DE"}`), opaque: 1},
+		{key: "FR", data: json.RawMessage(`{"key":"FR"}`), opaque: 2},
+	})
+
+	if accepting.received() != 1 || rejecting.received() != 1 {
+		t.Errorf("requests = %d and %d, want 1 to each URL", accepting.received(), rejecting.received())
+	}
+
+	for i := 0; i < 2; i++ {
+		if r := <-p.reports; r.Err == nil {
+			t.Errorf("report for %s has no error", r.Key)
+		}
+	}
+
+	file, err := os.Open(p.deadLetterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var entries []deadLetter
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("dead-letter line %q is not JSON: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("dead-letter file has %d entries, want 2", len(entries))
+	}
+	for i, key := range []string{"DE", "FR"} {
+		entry := entries[i]
+		if entry.Key != key || string(entry.Reading) != `{"key":"`+key+`"}` {
+			t.Errorf("entry %d: key = %s, reading = %s", i, entry.Key, entry.Reading)
+		}
+		if entry.URL != rejecting.URL {
+			t.Errorf("entry %d: url = %s, want %s", i, entry.URL, rejecting.URL)
+		}
+		if !strings.Contains(entry.Error, "status 400") {
+			t.Errorf("entry %d: error = %s, want status 400", i, entry.Error)
+		}
+		if _, err := time.Parse(time.RFC3339, entry.Time); err != nil {
+			t.Errorf("entry %d: time = %s: %v", i, entry.Time, err)
+		}
+	}
+}
+
+// TestWebhookCleanupTimeout checks that Cleanup aborts a request to a receiver that does not answer once the
+// cleanup timeout has passed, and that the reading is dead-lettered and reported as not delivered.
+func TestWebhookCleanupTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	t.Cleanup(hung.Close)
+	t.Cleanup(func() { close(release) })
+
+	p := newTestWebhookPublisher(t, hung.URL)
+	p.cleanupTimeout = 200 * time.Millisecond
+	go p.run()
+
+	if err := p.PublishData("DE", `{"key":"DE"}`, nil); err != nil {
+		t.Fatalf("PublishData() error = %v", err)
+	}
+
+	start := time.Now()
+	p.Cleanup()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Cleanup() took %v, want about %v", elapsed, p.cleanupTimeout)
+	}
+
+	if r := <-p.reports; r.Err == nil {
+		t.Errorf("report for %s has no error", r.Key)
+	}
+	if data, err := ioutil.ReadFile(p.deadLetterFile); err != nil || !strings.Contains(string(data), `"key":"DE"`) {
+		t.Errorf("dead-letter file = %s, %v", data, err)
+	}
+}
@@ -1,12 +1,15 @@
 package data_source
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
+	"fmt"
 	"log"
-	"net/http"
 	"os"
 
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
+
 	"github.com/itchyny/gojq"
 )
 
@@ -24,6 +27,7 @@ type co2SignalProviderResponse struct {
 	UnitValue            string  `json:"unit_value"`
 }
 
+const co2SignalSourceName string = "co2-signal"
 const wsEntryPoint string = "https://api.co2signal.com"
 const zonesURL string = "https://api.electricitymap.org/v3/zones"
 const apiVersion string = "v1/latest"
@@ -31,15 +35,20 @@ const queryByCountryCode string = "countryCode="
 const envVarName string = "CO2SIGNAL_API_KEY"
 const getKeysJQuery string = "keys | .[]"
 
-var dummyZoneList = [...]string{"US-AK", "US-CAL-BANC", "US-CAL-CISO", "US-CAL-IID", "US-CAL-LDWP", "US-CAR-CPLW", "US-CAR-DUK", "US-CAR-SC", "US-CAR-SCEG", "US-CAR-YAD", "US-CENT-SPA", "US-CENT-SWPP", "US-FLA-FMPP", "US-FLA-FPC", "US-FLA-FPL", "US-FLA-GVL", "US-FLA-SEC", "US-FLA-TAL", "US-FLA-TEC", "US-MIDA-PJM", "US-MIDW-AECI", "US-MIDW-GLHB", "US-MIDW-LGEE", "US-MIDW-MISO", "US-NE-ISNE", "US-NW-AVA", "US-NW-GCPD", "US-NW-GRID", "US-NW-GWA", "US-NW-IPCO"}
-
 // const getLengthJQuery string = "length"
 
+// co2SignalConfigItems returns the configuration items used by CO2 Signal. It allows one request per second.
+func co2SignalConfigItems() []config.Item {
+	return rateLimitConfigItems(co2SignalSourceName, 1, 1)
+}
+
 var authToken string
 
 // CO2SignalDataProvider is an implementation of the DataProvider interface.
 // It uses CO2 Signal as the data rovider for retireving carbon intensity of electricy generation.
 type CO2SignalDataProvider struct {
+	client   *httpClient
+	registry *zones.Registry
 }
 
 // Initialise is used as a kibd of "constructor" to set up any internal properties.
@@ -50,54 +59,80 @@ func (r *CO2SignalDataProvider) Initialise() {
 		log.Fatalf("CO2SignalDataProvider::Initialise(). API-key environment variable (%s) not set.", envVarName)
 	}
 	authToken = val
+
+	r.client = newHTTPClient(newRateLimiter(co2SignalSourceName))
+}
+
+// SetZoneRegistry assigns the registry that provides the country and zone names added to each reading.
+func (r *CO2SignalDataProvider) SetZoneRegistry(registry *zones.Registry) {
+	r.registry = registry
 }
 
-func (r *CO2SignalDataProvider) GetAvailableZones() []string {
+// GetAvailableZones returns every zone that electricitymap has data for.
+func (r *CO2SignalDataProvider) GetAvailableZones(ctx context.Context) ([]string, error) {
 
 	var input map[string]interface{}
-	r.getZones(&input)
-
-	zoneList := jqZoneList(&input)
-	log.Printf("All zones:\n%s", zoneList)
+	if err := r.getZones(ctx, &input); err != nil {
+		return nil, err
+	}
 
-	// TODO: remove this line once a full API key is available
-	zoneList = dummyZoneList[:]
+	zoneList, err := jqZoneList(&input)
+	if err != nil {
+		return nil, err
+	}
+	addZoneDetails(r.registry, input)
+	log.Printf("CO2SignalDataProvider::GetAvailableZones(): %d zones", len(zoneList))
 
-	return zoneList
+	return zoneList, nil
 }
 
 // GetZones retrieves the list of zones available form co2 signal and uses this to get the carbon intensity data.
-func (r *CO2SignalDataProvider) getZones(input *map[string]interface{}) {
+func (r *CO2SignalDataProvider) getZones(ctx context.Context, input *map[string]interface{}) error {
 	log.Printf("CO2SignalDataProvider::getZones()")
 
-	// TODO: Add a Context so it will time out.
-	response, err := http.Get(zonesURL)
+	responseData, err := r.client.get(ctx, "", zonesURL, nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	responseData, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		log.Fatal(err)
+	// Run all thew JQueries to extract the data
+	if err := json.Unmarshal(responseData, input); err != nil {
+		return newSourceError(ErrMalformedPayload, "", 0, err)
 	}
 
-	jsonResp := string(responseData)
-	// log.Println(jsonResp)
+	return nil
+}
 
-	// Run all thew JQueries to extract the data
-	json.Unmarshal([]byte(jsonResp), input)
+// addZoneDetails adds the names in an electricitymap zones response to the registry, for any zone that is not in
+// the countries file. A nil registry is ignored.
+func addZoneDetails(registry *zones.Registry, input map[string]interface{}) {
+	if registry == nil {
+		return
+	}
+
+	for zone, v := range input {
+		fields, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		var details zones.ZoneDetails
+		details.CountryName, _ = fields["countryName"].(string)
+		details.ZoneName, _ = fields["zoneName"].(string)
+		registry.AddMissing(zone, details)
+	}
 }
 
 // jqZoneList ueries a single path in a json message. It returns an interface because the caller
 // understands the context and will need to cast it to the appropriate type.
 // This can be used to search for a specific value at a path, or to return a subtree that
 // can be parsed further. E.g. Return a float of an array.
-func jqZoneList(input *map[string]interface{}) []string {
+func jqZoneList(input *map[string]interface{}) ([]string, error) {
 	var resp []string
 
 	query, err := gojq.Parse(getKeysJQuery)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	iter := query.Run(*input) // or query.RunWithContext
@@ -109,27 +144,29 @@ func jqZoneList(input *map[string]interface{}) []string {
 		// Interface{} result can be cast to a value or an Error type. So if true you should check
 		// if it was an error before checking for the result.
 		if err, more := value.(error); more {
-			log.Fatalln(err)
+			return nil, newSourceError(ErrMalformedPayload, "", 0, err)
 		} else if value == nil {
 			log.Println("WARNING: JQuery returned no result: ", getKeysJQuery)
+		} else if zone, ok := value.(string); ok {
+			resp = append(resp, zone)
 		} else {
-			resp = append(resp, value.(string))
+			return nil, newSourceError(ErrMalformedPayload, "", 0, fmt.Errorf("zone key is not a string: %v", value))
 		}
 	}
 
-	return resp
+	return resp, nil
 }
 
 // queryPath ueries a single path in a json message. It returns an interface because the caller
 // understands the context and will need to cast it to the appropriate type.
 // This can be used to search for a specific value at a path, or to return a subtree that
 // can be parsed further. E.g. Return a float of an array.
-func queryPath(input *map[string]interface{}, queryString string) interface{} {
+func queryPath(input *map[string]interface{}, queryString string) (interface{}, error) {
 	var resp interface{}
 
 	query, err := gojq.Parse(queryString)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	iter := query.Run(*input) // or query.RunWithContext
@@ -141,7 +178,7 @@ func queryPath(input *map[string]interface{}, queryString string) interface{} {
 		// Interface{} result can be cast to a value or an Error type. So if true you should check
 		// if it was an error before checking for the result.
 		if err, more := value.(error); more {
-			log.Fatalln(err)
+			return nil, err
 		} else if value == nil {
 			log.Println("WARNING: JQuery returned no result: ", queryString)
 		} else {
@@ -149,38 +186,47 @@ func queryPath(input *map[string]interface{}, queryString string) interface{} {
 		}
 	}
 
-	return resp
+	return resp, nil
 }
 
 // GetCarbonIntensity retrieves the carbon intensity of electricity for a given country code
 // from co2signal.com.
-func (r *CO2SignalDataProvider) GetCarbonIntensity(zone string) []DataSourceDetails {
+func (r *CO2SignalDataProvider) GetCarbonIntensity(ctx context.Context, zone string) ([]DataSourceDetails, error) {
 
 	log.Printf("CO2SignalDataProvider::GetCarbonIntensity(%s)", zone)
 
 	var resp []DataSourceDetails
 
 	req := r.constructRequest(zone, "")
-	jsonResp := r.requestData(req, authToken)
+	jsonResp, err := r.requestData(ctx, zone, req, authToken)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("CO2SignalDataProvider::GetCarbonIntensity(%s): %s", zone, jsonResp)
 
 	var co2Result DataSourceDetails
-	co2Result.Key, co2Result.ProviderResp = parseResponse(jsonResp)
-	if co2Result.Key != "" {
-		resp = append(resp, co2Result)
+	parsed, convertedJsonMsg, err := parseResponse(zone, jsonResp, r.registry)
+	if err != nil {
+		return nil, err
 	}
+	co2Result.Key, co2Result.Datetime, co2Result.ProviderResp = parsed.Key, parsed.Datetime, convertedJsonMsg
+	co2Result.Source = co2SignalSourceName
+	resp = append(resp, co2Result)
 
 	log.Printf("Parsed Response: %s : %s\n", co2Result.Key, co2Result.ProviderResp)
 
-	return resp
+	return resp, nil
 }
 
-// parseResponse extracts the FX details from the repsonse and stores it in a usable format
-// that is base don the CSV formst you can download form ECB. Input params are:
-// ecbJsonResp string: The json message returned from ECB
-// Returns "","" if there was an error parsing the response.
-func parseResponse(jsonResp string) (string, string) {
+// parseResponse extracts the carbon-intensity details from the response and converts them to the
+// format that is published. Input params are:
+// zone string: The zone that was requested. Used for error reporting.
+// jsonResp string: The json message returned from CO2 Signal
+// registry *zones.Registry: Provides the country and zone names. May be nil.
+// Returns an ErrZoneUnsupported error if CO2 Signal reports it has no data for the zone, or an
+// ErrMalformedPayload error if the response cannot be parsed.
+func parseResponse(zone string, jsonResp string, registry *zones.Registry) (co2SignalProviderResponse, string, error) {
 	var resp co2SignalProviderResponse
 
 	// A list of all the JQueries that are used.
@@ -196,93 +242,95 @@ func parseResponse(jsonResp string) (string, string) {
 
 	// Run all thew JQueries to extract the data
 	var input map[string]interface{}
-	json.Unmarshal([]byte(jsonResp), &input)
-
-	var jsonVal interface{}
-
-	jsonVal = queryPath(&input, queries["country-code"])
-	if jsonVal != nil {
-		resp.CountryCode = jsonVal.(string)
-	} else {
-		return "", ""
-	}
-
-	jsonVal = queryPath(&input, queries["status"])
-	if jsonVal != nil {
-		resp.Status = jsonVal.(string)
-	} else {
-		return "", ""
-	}
-
-	jsonVal = queryPath(&input, queries["datetime"])
-	if jsonVal != nil {
-		resp.Datetime = jsonVal.(string)
-	} else {
-		return "", ""
+	if err := json.Unmarshal([]byte(jsonResp), &input); err != nil {
+		return resp, "", newSourceError(ErrMalformedPayload, zone, 0, err)
 	}
 
-	jsonVal = queryPath(&input, queries["carbon-intensity"])
-	if jsonVal != nil {
-		resp.CarbonIntensity = jsonVal.(float64)
-	} else {
-		return "", ""
+	// The status is checked first because the data is missing when CO2 Signal does not support the zone.
+	status, err := queryString(&input, queries["status"])
+	if err != nil {
+		return resp, "", newSourceError(ErrMalformedPayload, zone, 0, err)
+	} else if status != "ok" {
+		message, _ := queryPath(&input, ".message")
+		return resp, "", newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("status %q: %v", status, message))
 	}
-
-	jsonVal = queryPath(&input, queries["fossel-fuel-percentage"])
-	if jsonVal != nil {
-		resp.FosselFuelPercentage = jsonVal.(float64)
-	} else {
-		return "", ""
+	resp.Status = status
+
+	fields := []struct {
+		query string
+		str   *string
+		num   *float64
+	}{
+		{query: queries["country-code"], str: &resp.CountryCode},
+		{query: queries["datetime"], str: &resp.Datetime},
+		{query: queries["carbon-intensity"], num: &resp.CarbonIntensity},
+		{query: queries["fossel-fuel-percentage"], num: &resp.FosselFuelPercentage},
+		{query: queries["unit-name"], str: &resp.UnitName},
+		{query: queries["unit-value"], str: &resp.UnitValue},
 	}
 
-	jsonVal = queryPath(&input, queries["unit-name"])
-	if jsonVal != nil {
-		resp.UnitName = jsonVal.(string)
-	} else {
-		return "", ""
-	}
-
-	jsonVal = queryPath(&input, queries["unit-value"])
-	if jsonVal != nil {
-		resp.UnitValue = jsonVal.(string)
-	} else {
-		return "", ""
+	for _, f := range fields {
+		if f.str != nil {
+			*f.str, err = queryString(&input, f.query)
+		} else {
+			*f.num, err = queryFloat(&input, f.query)
+		}
+		if err != nil {
+			return co2SignalProviderResponse{}, "", newSourceError(ErrMalformedPayload, zone, 0, err)
+		}
 	}
 
 	// Construct the key
 	resp.Key = resp.CountryCode
+	describeZone(registry, &resp)
 
 	// Format into a new JSON message
 	convertedJsonMsg, err := json.Marshal(resp)
 	if err != nil {
-		log.Fatal(err)
+		return co2SignalProviderResponse{}, "", newSourceError(ErrMalformedPayload, zone, 0, err)
 	}
 
-	return resp.Key, string(convertedJsonMsg)
+	return resp, string(convertedJsonMsg), nil
 }
 
-// requestData sends the request to the data provider and returns the response as a string.
-func (r *CO2SignalDataProvider) requestData(request string, token string) string {
-	client := http.Client{}
-	req, err := http.NewRequest("GET", request, nil)
+// queryString queries a path that must hold a string.
+func queryString(input *map[string]interface{}, query string) (string, error) {
+	jsonVal, err := queryPath(input, query)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	req.Header.Add("auth-token", token)
+	s, ok := jsonVal.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string: %v", query, jsonVal)
+	}
+
+	return s, nil
+}
 
-	// TODO: Add a Context so it will time out.
-	response, err := client.Do(req)
+// queryFloat queries a path that must hold a number.
+func queryFloat(input *map[string]interface{}, query string) (float64, error) {
+	jsonVal, err := queryPath(input, query)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 
-	responseData, err := ioutil.ReadAll(response.Body)
+	f, ok := jsonVal.(float64)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a number: %v", query, jsonVal)
+	}
+
+	return f, nil
+}
+
+// requestData sends the request to the data provider and returns the response as a string.
+func (r *CO2SignalDataProvider) requestData(ctx context.Context, zone string, request string, token string) (string, error) {
+	responseData, err := r.client.get(ctx, zone, request, map[string]string{"auth-token": token})
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
-	return string(responseData)
+	return string(responseData), nil
 }
 
 // constructRequest formats the http request message for the market-data provider.
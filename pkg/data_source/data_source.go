@@ -16,15 +16,54 @@
 // Each data source implements the IMarketDataSource interface.
 package data_source
 
+import (
+	"context"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
+)
+
+// ConfigItems returns the configuration items used by the data sources.
+func ConfigItems() []config.Item {
+	items := httpClientConfigItems()
+	items = append(items, simulatorConfigItems()...)
+	items = append(items, co2SignalConfigItems()...)
+	items = append(items, electricityMapsConfigItems()...)
+	items = append(items, ukCarbonIntensityConfigItems()...)
+	items = append(items, wattTimeConfigItems()...)
+	items = append(items, entsoeConfigItems()...)
+	items = append(items, eiaConfigItems()...)
+
+	return items
+}
+
 // DataSourceDetails is the standard structure that market data should be returned in.
 type DataSourceDetails struct {
 	Key          string
+	Datetime     string // The time the reading applies to, as reported by the provider.
+	Source       string // The name of the data source that produced the reading.
 	ProviderResp string
 }
 
 // IDataSource defines the interface that all data sources should implement.
+// Errors returned by GetCarbonIntensity and GetAvailableZones are *SourceError values, so the caller can
+// use errors.Is with the Err* values to decide whether to skip the zone, retry, or stop.
+// Requests are abandoned when the context is cancelled.
 type IDataSource interface {
 	Initialise()
-	GetCarbonIntensity(countryCode string) []DataSourceDetails
-	GetAvailableZones() []string
+	SetZoneRegistry(registry *zones.Registry) // Provides the country and zone names added to each reading.
+	GetCarbonIntensity(ctx context.Context, countryCode string) ([]DataSourceDetails, error)
+	GetAvailableZones(ctx context.Context) ([]string, error)
+}
+
+// describeZone fills in the country and zone names of a reading from the registry. A nil registry leaves
+// them empty.
+func describeZone(registry *zones.Registry, resp *co2SignalProviderResponse) {
+	if registry == nil {
+		return
+	}
+
+	details := registry.Describe(resp.Key)
+	resp.Country = details.Country()
+	resp.Zone = details.ZoneName
 }
@@ -0,0 +1,292 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
+)
+
+// Configuration items for the EIA data source.
+const (
+	eiaURLConfigItem             = "eia-url"                   // URL of the hourly generation by fuel type data.
+	eiaBalancingAuthConfigItem   = "eia-balancing-authorities" // Extra zones, as zone:balancing authority code.
+	eiaEmissionFactorsConfigItem = "eia-emission-factors-file" // Properties file of gCO2eq/kWh by fuel type.
+)
+
+// Defaults used if the configuration file does not set the EIA items.
+const (
+	defaultEIAURL             = "https://api.eia.gov/v2/electricity/rto/fuel-type-data/data/"
+	defaultEIAEmissionFactors = "./config/eia-emission-factors.properties"
+)
+
+const eiaSourceName string = "eia"
+const eiaEnvVarName string = "EIA_API_KEY"
+
+// The format of the start parameter and of the period of each value, an hour in UTC.
+const eiaPeriodFormat = "2006-01-02T15"
+
+// The period before now that is requested. Balancing authorities report an hour or two after real time, and some
+// fuel types later than others, so this covers the latest hour every fuel type has reported.
+const eiaLookback = 12 * time.Hour
+
+// The most values returned by a request, which is the API's limit. 12 hours of every fuel type is far fewer.
+const eiaMaxLength = "5000"
+
+// The balancing authorities that report to the Hourly Electric Grid Monitor, by the zone key Electricity Maps uses
+// for them. The code is the last part of the key. More can be added with eia-balancing-authorities.
+var eiaBalancingAuthorities = map[string]string{
+	"US-CAL-BANC": "BANC", "US-CAL-CISO": "CISO", "US-CAL-IID": "IID", "US-CAL-LDWP": "LDWP", "US-CAL-TIDC": "TIDC",
+	"US-CAR-CPLE": "CPLE", "US-CAR-CPLW": "CPLW", "US-CAR-DUK": "DUK", "US-CAR-SC": "SC", "US-CAR-SCEG": "SCEG",
+	"US-CAR-YAD": "YAD", "US-CENT-SPA": "SPA", "US-CENT-SWPP": "SWPP", "US-FLA-FMPP": "FMPP", "US-FLA-FPC": "FPC",
+	"US-FLA-FPL": "FPL", "US-FLA-GVL": "GVL", "US-FLA-HST": "HST", "US-FLA-JEA": "JEA", "US-FLA-NSB": "NSB",
+	"US-FLA-SEC": "SEC", "US-FLA-TAL": "TAL", "US-FLA-TEC": "TEC", "US-MIDA-PJM": "PJM", "US-MIDW-AECI": "AECI",
+	"US-MIDW-GLHB": "GLHB", "US-MIDW-LGEE": "LGEE", "US-MIDW-MISO": "MISO", "US-NE-ISNE": "ISNE", "US-NW-AVA": "AVA",
+	"US-NW-AVRN": "AVRN", "US-NW-BPAT": "BPAT", "US-NW-CHPD": "CHPD", "US-NW-DOPD": "DOPD", "US-NW-GCPD": "GCPD",
+	"US-NW-GRID": "GRID", "US-NW-GWA": "GWA", "US-NW-IPCO": "IPCO", "US-NW-NEVP": "NEVP", "US-NW-NWMT": "NWMT",
+	"US-NW-PACE": "PACE", "US-NW-PACW": "PACW", "US-NW-PGE": "PGE", "US-NW-PSCO": "PSCO", "US-NW-PSEI": "PSEI",
+	"US-NW-SCL": "SCL", "US-NW-TPWR": "TPWR", "US-NW-WACM": "WACM", "US-NW-WAUW": "WAUW", "US-NW-WWA": "WWA",
+	"US-NY-NYIS": "NYIS", "US-SE-AEC": "AEC", "US-SE-SEPA": "SEPA", "US-SE-SOCO": "SOCO", "US-SW-AZPS": "AZPS",
+	"US-SW-DEAA": "DEAA", "US-SW-EPE": "EPE", "US-SW-GRIF": "GRIF", "US-SW-GRMA": "GRMA", "US-SW-HGMA": "HGMA",
+	"US-SW-PNM": "PNM", "US-SW-SRP": "SRP", "US-SW-TEPC": "TEPC", "US-SW-WALC": "WALC", "US-TEN-TVA": "TVA",
+	"US-TEX-ERCO": "ERCO",
+}
+
+// Fuel types that are fossil fuels: coal, natural gas and petroleum.
+var eiaFossilFuels = map[string]bool{"COL": true, "NG": true, "OIL": true}
+
+// eiaConfigItems returns the configuration items used by EIA. It allows about 5 requests a second per API key.
+func eiaConfigItems() []config.Item {
+	items := []config.Item{
+		{Key: eiaURLConfigItem, Kind: config.KindString, Default: defaultEIAURL},
+		{Key: eiaBalancingAuthConfigItem, Kind: config.KindList, Check: func(value string) error {
+			_, err := parseBalancingAuthorities(config.SplitList(value))
+			return err
+		}},
+		{Key: eiaEmissionFactorsConfigItem, Kind: config.KindString, Default: defaultEIAEmissionFactors},
+	}
+
+	return append(items, rateLimitConfigItems(eiaSourceName, 1, 5)...)
+}
+
+// eiaResponse is a response from the EIA Open Data v2 API. Errors are returned in the error field.
+type eiaResponse struct {
+	Error    json.RawMessage `json:"error"`
+	Response struct {
+		Data []struct {
+			Period     string   `json:"period"`     // The hour the generation ended, e.g. 2022-10-17T15.
+			Respondent string   `json:"respondent"` // The balancing authority.
+			FuelType   string   `json:"fueltype"`   // e.g. COL, NG, NUC, WAT, SUN or WND.
+			Value      eiaValue `json:"value"`      // MWh generated in the hour.
+		} `json:"data"`
+	} `json:"response"`
+}
+
+// eiaValue is a value in an EIA response, which may be a number, a string holding a number, or null.
+type eiaValue struct {
+	Value float64
+	Valid bool
+}
+
+// UnmarshalJSON parses a number, a string holding a number, or null.
+func (v *eiaValue) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		*v = eiaValue{}
+		return nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("value %s is not a number", data)
+	}
+	*v = eiaValue{Value: f, Valid: true}
+
+	return nil
+}
+
+// EIADataProvider is an implementation of the IDataSource that uses the US Energy Information Administration's
+// Hourly Electric Grid Monitor, which is free and covers the US balancing authorities. It reads the net generation
+// by fuel type of a balancing authority and calculates the carbon intensity of the generation from a table of
+// emission factors per fuel type. Readings have the same schema as CO2 Signal's.
+type EIADataProvider struct {
+	client               *httpClient
+	registry             *zones.Registry
+	baseURL              string
+	apiKey               string
+	balancingAuthorities map[string]string
+	emissionFactors      map[string]float64 // gCO2eq/kWh by fuel type, e.g. NG for natural gas.
+}
+
+// Initialise reads the API key from the environment, and the settings and emission factors from the configuration
+// files.
+func (r *EIADataProvider) Initialise() {
+	val, ok := os.LookupEnv(eiaEnvVarName)
+	if !ok || val == "" {
+		log.Fatalf("EIADataProvider::Initialise(). API-key environment variable (%s) not set.", eiaEnvVarName)
+	}
+	r.apiKey = val
+
+	appConfig := config.App()
+	r.baseURL = appConfig.String(eiaURLConfigItem)
+
+	extra, err := parseBalancingAuthorities(appConfig.List(eiaBalancingAuthConfigItem))
+	if err != nil {
+		log.Fatalf("EIADataProvider::Initialise(): %v", err)
+	}
+	r.balancingAuthorities = make(map[string]string, len(eiaBalancingAuthorities)+len(extra))
+	for zone, ba := range eiaBalancingAuthorities {
+		r.balancingAuthorities[zone] = ba
+	}
+	for zone, ba := range extra {
+		r.balancingAuthorities[zone] = ba
+	}
+
+	factorsFile := appConfig.String(eiaEmissionFactorsConfigItem)
+	r.emissionFactors, err = loadEmissionFactors(factorsFile)
+	if err != nil {
+		log.Fatalf("EIADataProvider::Initialise(): Failed to load the emission factors: %v", err)
+	}
+
+	r.client = newHTTPClient(newRateLimiter(eiaSourceName))
+
+	log.Printf("EIADataProvider::Initialise(): url=%s zones=%d emission-factors=%s", r.baseURL, len(r.balancingAuthorities), factorsFile)
+}
+
+// SetZoneRegistry assigns the registry that provides the country and zone names added to each reading.
+func (r *EIADataProvider) SetZoneRegistry(registry *zones.Registry) {
+	r.registry = registry
+}
+
+// GetAvailableZones returns the zones that have a balancing authority.
+func (r *EIADataProvider) GetAvailableZones(ctx context.Context) ([]string, error) {
+	zoneList := make([]string, 0, len(r.balancingAuthorities))
+	for zone := range r.balancingAuthorities {
+		zoneList = append(zoneList, zone)
+	}
+	sort.Strings(zoneList)
+
+	return zoneList, nil
+}
+
+// GetCarbonIntensity retrieves the recent generation of the zone's balancing authority and calculates the carbon
+// intensity of the latest hour every fuel type has reported.
+// https://api.eia.gov/v2/electricity/rto/fuel-type-data/data/?frequency=hourly&facets[respondent][]=CISO&...
+func (r *EIADataProvider) GetCarbonIntensity(ctx context.Context, zone string) ([]DataSourceDetails, error) {
+	log.Printf("EIADataProvider::GetCarbonIntensity(%s)", zone)
+
+	ba, ok := r.balancingAuthorities[zone]
+	if !ok {
+		return nil, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no balancing authority. Add one with %s", eiaBalancingAuthConfigItem))
+	}
+
+	query := url.Values{}
+	query.Set("api_key", r.apiKey)
+	query.Set("frequency", "hourly")
+	query.Set("data[0]", "value")
+	query.Set("facets[respondent][]", ba)
+	query.Set("start", time.Now().UTC().Add(-eiaLookback).Format(eiaPeriodFormat))
+	query.Set("sort[0][column]", "period")
+	query.Set("sort[0][direction]", "desc")
+	query.Set("length", eiaMaxLength)
+
+	responseData, err := r.client.get(ctx, zone, r.baseURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	generation, err := parseEIAGeneration(zone, ba, responseData)
+	if err != nil {
+		return nil, err
+	}
+
+	reading, err := intensityFromGeneration(zone, generation, r.emissionFactors, eiaFossilFuels)
+	if err != nil {
+		return nil, err
+	}
+	describeZone(r.registry, &reading)
+
+	msg, err := json.Marshal(reading)
+	if err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	log.Printf("Parsed Response: %s : %s\n", reading.Key, msg)
+
+	return []DataSourceDetails{{Key: reading.Key, Datetime: reading.Datetime, Source: eiaSourceName, ProviderResp: string(msg)}}, nil
+}
+
+// parseEIAGeneration parses a response into the generation, in MW, of each fuel type in each hour. A fuel type's
+// MWh in an hour is its average MW over the hour. The hour is the one the generation ended. Values that are null
+// are left out. Returns an ErrZoneUnsupported error if the balancing authority has no generation, or an
+// ErrMalformedPayload error if the response cannot be parsed.
+func parseEIAGeneration(zone string, ba string, data []byte) (generationMix, error) {
+	var resp eiaResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	if len(resp.Error) > 0 && string(resp.Error) != "null" {
+		return nil, newSourceError(ErrUpstream, zone, 0, fmt.Errorf("%s", resp.Error))
+	}
+
+	generation := make(generationMix)
+	for _, value := range resp.Response.Data {
+		if value.Respondent != ba || value.FuelType == "" || !value.Value.Valid {
+			continue
+		}
+
+		at, err := time.Parse(eiaPeriodFormat, value.Period)
+		if err != nil {
+			return nil, newSourceError(ErrMalformedPayload, zone, 0, fmt.Errorf("invalid period %s", value.Period))
+		}
+
+		if generation[value.FuelType] == nil {
+			generation[value.FuelType] = make(map[time.Time]float64)
+		}
+		generation[value.FuelType][at] += value.Value.Value
+	}
+
+	if len(generation) == 0 {
+		return nil, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no generation for %s", ba))
+	}
+
+	return generation, nil
+}
+
+// parseBalancingAuthorities parses a list of zone:balancing authority code, e.g. US-NW-BPAT:BPAT.
+func parseBalancingAuthorities(list []string) (map[string]string, error) {
+	balancingAuthorities := make(map[string]string)
+	for _, entry := range list {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s is not zone:balancing authority code", entry)
+		}
+		balancingAuthorities[parts[0]] = strings.ToUpper(parts[1])
+	}
+
+	return balancingAuthorities, nil
+}
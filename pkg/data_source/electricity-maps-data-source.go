@@ -0,0 +1,293 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
+)
+
+// Configuration items for the Electricity Maps data source.
+const (
+	electricityMapsURLConfigItem            = "electricity-maps-url"                  // Base URL of the v3 API.
+	electricityMapsEmissionFactorConfigItem = "electricity-maps-emission-factor-type" // lifecycle or direct.
+	electricityMapsBreakdownConfigItem      = "electricity-maps-power-breakdown"      // Also request the power breakdown of each zone.
+)
+
+// Defaults used if the configuration file does not set the Electricity Maps items.
+const (
+	defaultElectricityMapsURL            = "https://api.electricitymap.org/v3"
+	defaultElectricityMapsEmissionFactor = "lifecycle"
+	defaultElectricityMapsBreakdown      = "true"
+)
+
+const electricityMapsSourceName string = "electricity-maps"
+const electricityMapsEnvVarName string = "ELECTRICITY_MAPS_API_KEY"
+
+// electricityMapsConfigItems returns the configuration items used by Electricity Maps. Each reading takes two
+// requests when the power breakdown is included.
+func electricityMapsConfigItems() []config.Item {
+	items := []config.Item{
+		{Key: electricityMapsURLConfigItem, Kind: config.KindString, Default: defaultElectricityMapsURL},
+		{Key: electricityMapsEmissionFactorConfigItem, Kind: config.KindString, Default: defaultElectricityMapsEmissionFactor,
+			Options: []string{"lifecycle", "direct"}},
+		{Key: electricityMapsBreakdownConfigItem, Kind: config.KindBool, Default: defaultElectricityMapsBreakdown},
+	}
+
+	return append(items, rateLimitConfigItems(electricityMapsSourceName, 1, 2)...)
+}
+
+// electricityMapsReading is the extended schema published by the Electricity Maps data source. It has every field
+// of the CO2 Signal schema, so existing consumers can read it, followed by the power breakdown of the zone.
+// The breakdowns are in MW. Fuel names have spaces replaced by underscores, e.g. hydro_discharge. Imports and
+// exports are keyed by the neighbouring zone. Values the API does not know are null. fossel_fuel_percentage comes
+// from the power breakdown, so it is null when there is none rather than 0, which would read as no fossil fuel.
+type electricityMapsReading struct {
+	co2SignalProviderResponse
+	FosselFuelPercentage      *float64            `json:"fossel_fuel_percentage"` // Replaces the field of the CO2 Signal schema.
+	EmissionFactorType        string              `json:"emission_factor_type"`   // lifecycle or direct.
+	IsEstimated               bool                `json:"is_estimated"`
+	EstimationMethod          string              `json:"estimation_method,omitempty"`
+	FossilFreePercentage      *float64            `json:"fossil_free_percentage"`
+	RenewablePercentage       *float64            `json:"renewable_percentage"`
+	PowerProductionBreakdown  map[string]*float64 `json:"power_production_breakdown"`
+	PowerConsumptionBreakdown map[string]*float64 `json:"power_consumption_breakdown"`
+	PowerImportBreakdown      map[string]*float64 `json:"power_import_breakdown"`
+	PowerExportBreakdown      map[string]*float64 `json:"power_export_breakdown"`
+	PowerProductionTotal      *float64            `json:"power_production_total"`
+	PowerConsumptionTotal     *float64            `json:"power_consumption_total"`
+	PowerImportTotal          *float64            `json:"power_import_total"`
+	PowerExportTotal          *float64            `json:"power_export_total"`
+}
+
+// electricityMapsCarbonIntensity is the response of the carbon-intensity/latest endpoint.
+type electricityMapsCarbonIntensity struct {
+	Zone               string   `json:"zone"`
+	CarbonIntensity    *float64 `json:"carbonIntensity"`
+	Datetime           string   `json:"datetime"`
+	EmissionFactorType string   `json:"emissionFactorType"`
+	IsEstimated        bool     `json:"isEstimated"`
+	EstimationMethod   *string  `json:"estimationMethod"`
+}
+
+// electricityMapsPowerBreakdown is the response of the power-breakdown/latest endpoint.
+type electricityMapsPowerBreakdown struct {
+	Zone                      string              `json:"zone"`
+	Datetime                  string              `json:"datetime"`
+	PowerProductionBreakdown  map[string]*float64 `json:"powerProductionBreakdown"`
+	PowerConsumptionBreakdown map[string]*float64 `json:"powerConsumptionBreakdown"`
+	PowerImportBreakdown      map[string]*float64 `json:"powerImportBreakdown"`
+	PowerExportBreakdown      map[string]*float64 `json:"powerExportBreakdown"`
+	FossilFreePercentage      *float64            `json:"fossilFreePercentage"`
+	RenewablePercentage       *float64            `json:"renewablePercentage"`
+	PowerProductionTotal      *float64            `json:"powerProductionTotal"`
+	PowerConsumptionTotal     *float64            `json:"powerConsumptionTotal"`
+	PowerImportTotal          *float64            `json:"powerImportTotal"`
+	PowerExportTotal          *float64            `json:"powerExportTotal"`
+}
+
+// ElectricityMapsDataProvider is an implementation of the IDataSource that uses the Electricity Maps v3 API. It
+// reads the latest carbon intensity of a zone and, optionally, its power breakdown: the generation and consumption
+// mix by fuel and the flows to and from neighbouring zones. config/electricity-maps-trino-schema.json describes
+// the readings.
+type ElectricityMapsDataProvider struct {
+	client             *httpClient
+	registry           *zones.Registry
+	baseURL            string
+	authToken          string
+	emissionFactorType string
+	powerBreakdown     bool
+}
+
+// Initialise reads the API key from the environment and the settings from the configuration file.
+func (r *ElectricityMapsDataProvider) Initialise() {
+	val, ok := os.LookupEnv(electricityMapsEnvVarName)
+	if !ok || val == "" {
+		log.Fatalf("ElectricityMapsDataProvider::Initialise(). API-key environment variable (%s) not set.", electricityMapsEnvVarName)
+	}
+	r.authToken = val
+
+	appConfig := config.App()
+	r.baseURL = strings.TrimSuffix(appConfig.String(electricityMapsURLConfigItem), "/")
+	r.emissionFactorType = appConfig.String(electricityMapsEmissionFactorConfigItem)
+	r.powerBreakdown = appConfig.Bool(electricityMapsBreakdownConfigItem)
+
+	r.client = newHTTPClient(newRateLimiter(electricityMapsSourceName))
+
+	log.Printf("ElectricityMapsDataProvider::Initialise(): url=%s emission-factor-type=%s power-breakdown=%v",
+		r.baseURL, r.emissionFactorType, r.powerBreakdown)
+}
+
+// SetZoneRegistry assigns the registry that provides the country and zone names added to each reading.
+func (r *ElectricityMapsDataProvider) SetZoneRegistry(registry *zones.Registry) {
+	r.registry = registry
+}
+
+// GetAvailableZones returns every zone that Electricity Maps has data for.
+func (r *ElectricityMapsDataProvider) GetAvailableZones(ctx context.Context) ([]string, error) {
+	responseData, err := r.client.get(ctx, "", r.baseURL+"/zones", r.headers())
+	if err != nil {
+		return nil, err
+	}
+
+	var input map[string]interface{}
+	if err := json.Unmarshal(responseData, &input); err != nil {
+		return nil, newSourceError(ErrMalformedPayload, "", 0, err)
+	}
+
+	zoneList, err := jqZoneList(&input)
+	if err != nil {
+		return nil, err
+	}
+	addZoneDetails(r.registry, input)
+	log.Printf("ElectricityMapsDataProvider::GetAvailableZones(): %d zones", len(zoneList))
+
+	return zoneList, nil
+}
+
+// GetCarbonIntensity retrieves the latest carbon intensity of electricity, and the power breakdown if it is
+// enabled, for the zone.
+func (r *ElectricityMapsDataProvider) GetCarbonIntensity(ctx context.Context, zone string) ([]DataSourceDetails, error) {
+	log.Printf("ElectricityMapsDataProvider::GetCarbonIntensity(%s)", zone)
+
+	var intensity electricityMapsCarbonIntensity
+	if err := r.getLatest(ctx, zone, "carbon-intensity", &intensity); err != nil {
+		return nil, err
+	}
+
+	var breakdown *electricityMapsPowerBreakdown
+	if r.powerBreakdown {
+		breakdown = &electricityMapsPowerBreakdown{}
+		if err := r.getLatest(ctx, zone, "power-breakdown", breakdown); err != nil {
+			return nil, err
+		}
+	}
+
+	reading, err := convertElectricityMaps(zone, intensity, breakdown)
+	if err != nil {
+		return nil, err
+	}
+	describeZone(r.registry, &reading.co2SignalProviderResponse)
+
+	msg, err := json.Marshal(reading)
+	if err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	log.Printf("Parsed Response: %s : %s\n", reading.Key, msg)
+
+	return []DataSourceDetails{{Key: reading.Key, Datetime: reading.Datetime, Source: electricityMapsSourceName, ProviderResp: string(msg)}}, nil
+}
+
+// getLatest requests the latest values of an endpoint, e.g. carbon-intensity, for the zone and decodes the response.
+// https://api.electricitymap.org/v3/carbon-intensity/latest?zone=FR&emissionFactorType=lifecycle
+func (r *ElectricityMapsDataProvider) getLatest(ctx context.Context, zone string, endpoint string, resp interface{}) error {
+	query := url.Values{}
+	query.Set("zone", zone)
+	query.Set("emissionFactorType", r.emissionFactorType)
+	request := r.baseURL + "/" + endpoint + "/latest?" + query.Encode()
+
+	responseData, err := r.client.get(ctx, zone, request, r.headers())
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(responseData, resp); err != nil {
+		return newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	return nil
+}
+
+// headers returns the headers that authenticate a request.
+func (r *ElectricityMapsDataProvider) headers() map[string]string {
+	return map[string]string{"auth-token": r.authToken}
+}
+
+// convertElectricityMaps converts the responses for a zone to the published schema. The breakdown may be nil.
+// Returns an ErrZoneUnsupported error if there is no carbon intensity for the zone, or an ErrMalformedPayload
+// error if the responses are incomplete.
+func convertElectricityMaps(zone string, intensity electricityMapsCarbonIntensity, breakdown *electricityMapsPowerBreakdown) (electricityMapsReading, error) {
+	var reading electricityMapsReading
+
+	if intensity.CarbonIntensity == nil {
+		return reading, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no carbon intensity"))
+	}
+	if intensity.Datetime == "" {
+		return reading, newSourceError(ErrMalformedPayload, zone, 0, fmt.Errorf("no datetime"))
+	}
+
+	reading.Key = zone
+	reading.CountryCode = zone
+	reading.Status = "ok"
+	reading.Datetime = intensity.Datetime
+	reading.CarbonIntensity = *intensity.CarbonIntensity
+	reading.UnitName = "carbonIntensity"
+	reading.UnitValue = "gCO2eq/kWh"
+	reading.EmissionFactorType = intensity.EmissionFactorType
+	reading.IsEstimated = intensity.IsEstimated
+	if intensity.EstimationMethod != nil {
+		reading.EstimationMethod = *intensity.EstimationMethod
+	}
+
+	if breakdown == nil {
+		return reading, nil
+	}
+
+	if breakdown.Datetime != intensity.Datetime {
+		log.Printf("WARNING: Power breakdown for %s is for %s but the carbon intensity is for %s", zone,
+			breakdown.Datetime, intensity.Datetime)
+	}
+
+	if breakdown.FossilFreePercentage != nil {
+		fossil := 100 - *breakdown.FossilFreePercentage
+		reading.FosselFuelPercentage = &fossil
+	}
+	reading.FossilFreePercentage = breakdown.FossilFreePercentage
+	reading.RenewablePercentage = breakdown.RenewablePercentage
+	reading.PowerProductionBreakdown = fuelNames(breakdown.PowerProductionBreakdown)
+	reading.PowerConsumptionBreakdown = fuelNames(breakdown.PowerConsumptionBreakdown)
+	reading.PowerImportBreakdown = breakdown.PowerImportBreakdown
+	reading.PowerExportBreakdown = breakdown.PowerExportBreakdown
+	reading.PowerProductionTotal = breakdown.PowerProductionTotal
+	reading.PowerConsumptionTotal = breakdown.PowerConsumptionTotal
+	reading.PowerImportTotal = breakdown.PowerImportTotal
+	reading.PowerExportTotal = breakdown.PowerExportTotal
+
+	return reading, nil
+}
+
+// fuelNames replaces the spaces in the fuel names of a breakdown with underscores, e.g. "hydro discharge" becomes
+// hydro_discharge, so they can be used as column names.
+func fuelNames(breakdown map[string]*float64) map[string]*float64 {
+	if breakdown == nil {
+		return nil
+	}
+
+	renamed := make(map[string]*float64, len(breakdown))
+	for fuel, mw := range breakdown {
+		renamed[strings.ReplaceAll(fuel, " ", "_")] = mw
+	}
+
+	return renamed
+}
@@ -0,0 +1,111 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// generationMix is the generation, in MW, of each fuel or production type at each time. It is used by the data
+// sources that calculate carbon intensity from generation data instead of reading it.
+type generationMix map[string]map[time.Time]float64
+
+// latestComplete returns the latest time every fuel has reported, so a fuel whose data arrives late does not make
+// the mix look cleaner or dirtier than it was.
+func (g generationMix) latestComplete() time.Time {
+	var at time.Time
+	for _, series := range g {
+		var latest time.Time
+		for t := range series {
+			if t.After(latest) {
+				latest = t
+			}
+		}
+		if at.IsZero() || latest.Before(at) {
+			at = latest
+		}
+	}
+
+	return at
+}
+
+// intensityFromGeneration calculates the carbon intensity of the generation at the latest time every fuel has
+// reported: the sum of the generation of each fuel multiplied by its emission factor, divided by the total
+// generation. Fuels that have no emission factor, and negative generation such as storage charging, are left out.
+// Returns a reading in the CO2 Signal schema, or an ErrZoneUnsupported error if there is no generation.
+func intensityFromGeneration(zone string, generation generationMix, factors map[string]float64, fossil map[string]bool) (co2SignalProviderResponse, error) {
+	var resp co2SignalProviderResponse
+
+	at := generation.latestComplete()
+
+	var total, emissions, fossilTotal float64
+	for fuel, series := range generation {
+		mw, ok := series[at]
+		if !ok || mw <= 0 {
+			continue
+		}
+
+		factor, ok := factors[fuel]
+		if !ok {
+			log.Printf("WARNING: No emission factor for %s in %s. It is left out.", fuel, zone)
+			continue
+		}
+
+		total += mw
+		emissions += mw * factor
+		if fossil[fuel] {
+			fossilTotal += mw
+		}
+	}
+
+	if total == 0 {
+		return resp, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no generation at %s", at.Format(time.RFC3339)))
+	}
+
+	resp.Key = zone
+	resp.CountryCode = zone
+	resp.Status = "ok"
+	resp.Datetime = at.UTC().Format(co2SignalDatetimeFormat)
+	resp.CarbonIntensity = emissions / total
+	resp.FosselFuelPercentage = 100 * fossilTotal / total
+	resp.UnitName = "carbonIntensity"
+	resp.UnitValue = "gCO2eq/kWh"
+
+	return resp, nil
+}
+
+// loadEmissionFactors reads a properties file of fuel=gCO2eq/kWh, e.g. B04=490.
+func loadEmissionFactors(file string) (map[string]float64, error) {
+	props, err := config.ReadProperties(file)
+	if err != nil {
+		return nil, err
+	}
+
+	factors := make(map[string]float64, len(props))
+	for fuel, value := range props {
+		factor, err := strconv.ParseFloat(value, 64)
+		if err != nil || factor < 0 {
+			return nil, fmt.Errorf("%s: emission factor for %s (%s) must be a number no smaller than 0", file, fuel, value)
+		}
+		factors[fuel] = factor
+	}
+
+	return factors, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestIntensityFromGeneration(t *testing.T) {
+	factors := map[string]float64{"B04": 490, "B10": 0, "B19": 11}
+
+	tests := []struct {
+		name          string
+		generation    generationMix
+		wantDatetime  string
+		wantIntensity float64
+		wantFossil    float64
+		wantErr       error
+	}{
+		{
+			name:          "gas and wind",
+			generation:    generationMix{"B04": {entsoeTime(10, 0): 100}, "B19": {entsoeTime(10, 0): 300}},
+			wantDatetime:  "2022-10-17T10:00:00.000Z",
+			wantIntensity: 52300.0 / 400,
+			wantFossil:    25,
+		},
+		{
+			// B99 is not a production type with an emission factor, so it is left out of the total too.
+			name:          "unknown production type",
+			generation:    generationMix{"B04": {entsoeTime(10, 0): 100}, "B19": {entsoeTime(10, 0): 300}, "B99": {entsoeTime(10, 0): 200}},
+			wantDatetime:  "2022-10-17T10:00:00.000Z",
+			wantIntensity: 52300.0 / 400,
+			wantFossil:    25,
+		},
+		{
+			name:          "storage charging",
+			generation:    generationMix{"B04": {entsoeTime(10, 0): 100}, "B10": {entsoeTime(10, 0): -50}, "B19": {entsoeTime(10, 0): 300}},
+			wantDatetime:  "2022-10-17T10:00:00.000Z",
+			wantIntensity: 52300.0 / 400,
+			wantFossil:    25,
+		},
+		{
+			// Wind has not reported 11:00 yet, so 10:00 is the latest complete time.
+			name:          "late production type",
+			generation:    generationMix{"B04": {entsoeTime(10, 0): 100, entsoeTime(11, 0): 400}, "B19": {entsoeTime(10, 0): 300}},
+			wantDatetime:  "2022-10-17T10:00:00.000Z",
+			wantIntensity: 52300.0 / 400,
+			wantFossil:    25,
+		},
+		{
+			name:       "only unknown production types",
+			generation: generationMix{"B98": {entsoeTime(10, 0): 100}, "B99": {entsoeTime(10, 0): 200}},
+			wantErr:    ErrZoneUnsupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := intensityFromGeneration("DE", tt.generation, factors, entsoeFossilTypes)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("intensityFromGeneration() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("intensityFromGeneration() error = %v", err)
+			}
+
+			if got.Key != "DE" || got.Datetime != tt.wantDatetime {
+				t.Errorf("key = %s, datetime = %s, want DE, %s", got.Key, got.Datetime, tt.wantDatetime)
+			}
+			if math.Abs(got.CarbonIntensity-tt.wantIntensity) > 1e-9 {
+				t.Errorf("carbon_intensity = %g, want %g", got.CarbonIntensity, tt.wantIntensity)
+			}
+			if math.Abs(got.FosselFuelPercentage-tt.wantFossil) > 1e-9 {
+				t.Errorf("fossel_fuel_percentage = %g, want %g", got.FosselFuelPercentage, tt.wantFossil)
+			}
+		})
+	}
+}
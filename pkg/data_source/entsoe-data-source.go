@@ -0,0 +1,309 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
+)
+
+// Configuration items for the ENTSO-E data source.
+const (
+	entsoeURLConfigItem             = "entsoe-url"                   // URL of the Transparency Platform's API.
+	entsoeBiddingZonesConfigItem    = "entsoe-bidding-zones"         // Extra zones, as zone:EIC code.
+	entsoeEmissionFactorsConfigItem = "entsoe-emission-factors-file" // Properties file of gCO2eq/kWh by production type.
+)
+
+// Defaults used if the configuration file does not set the ENTSO-E items.
+const (
+	defaultEntsoeURL             = "https://web-api.tp.entsoe.eu/api"
+	defaultEntsoeEmissionFactors = "./config/entsoe-emission-factors.properties"
+)
+
+const entsoeSourceName string = "entsoe"
+const entsoeEnvVarName string = "ENTSOE_SECURITY_TOKEN"
+
+// The format of the periodStart and periodEnd parameters, and of the times in the documents.
+const (
+	entsoeParamFormat    = "200601021504"
+	entsoeDatetimeFormat = "2006-01-02T15:04Z"
+)
+
+// The period before now that is requested. Generation is published up to an hour or so after real time, so this
+// covers the latest complete data of every production type.
+const entsoeLookback = 6 * time.Hour
+
+// The reason code of an acknowledgement document that means there is no data for the request.
+const entsoeNoDataReason = "999"
+
+// The EIC codes of the bidding zones and control areas that generation is published for, by zone key. More can be
+// added with entsoe-bidding-zones.
+var entsoeBiddingZones = map[string]string{
+	"AT": "10YAT-APG------L", "BE": "10YBE----------2", "BG": "10YCA-BULGARIA-R", "CH": "10YCH-SWISSGRIDZ",
+	"CZ": "10YCZ-CEPS-----N", "DE": "10Y1001A1001A83F", "DK-DK1": "10YDK-1--------W", "DK-DK2": "10YDK-2--------M",
+	"EE": "10Y1001A1001A39I", "ES": "10YES-REE------0", "FI": "10YFI-1--------U", "FR": "10YFR-RTE------C",
+	"GR": "10YGR-HTSO-----Y", "HR": "10YHR-HEP------M", "HU": "10YHU-MAVIR----U", "IE": "10YIE-1001A00010",
+	"LT": "10YLT-1001A0008Q", "LV": "10YLV-1001A00074", "NL": "10YNL----------L", "NO-NO1": "10YNO-1--------2",
+	"NO-NO2": "10YNO-2--------T", "NO-NO3": "10YNO-3--------J", "NO-NO4": "10YNO-4--------9",
+	"NO-NO5": "10Y1001A1001A48H", "PL": "10YPL-AREA-----S", "PT": "10YPT-REN------W", "RO": "10YRO-TEL------P",
+	"RS": "10YCS-SERBIATSOV", "SE-SE1": "10Y1001A1001A44P", "SE-SE2": "10Y1001A1001A45N",
+	"SE-SE3": "10Y1001A1001A46L", "SE-SE4": "10Y1001A1001A47J", "SI": "10YSI-ELES-----O", "SK": "10YSK-SEPS-----K",
+}
+
+// Production types that burn fossil fuels: lignite, coal-derived gas, gas, hard coal, oil, oil shale and peat.
+var entsoeFossilTypes = map[string]bool{"B02": true, "B03": true, "B04": true, "B05": true, "B06": true, "B07": true, "B08": true}
+
+// entsoeConfigItems returns the configuration items used by ENTSO-E. It allows 400 requests a minute.
+func entsoeConfigItems() []config.Item {
+	items := []config.Item{
+		{Key: entsoeURLConfigItem, Kind: config.KindString, Default: defaultEntsoeURL},
+		{Key: entsoeBiddingZonesConfigItem, Kind: config.KindList, Check: func(value string) error {
+			_, err := parseBiddingZones(config.SplitList(value))
+			return err
+		}},
+		{Key: entsoeEmissionFactorsConfigItem, Kind: config.KindString, Default: defaultEntsoeEmissionFactors},
+	}
+
+	return append(items, rateLimitConfigItems(entsoeSourceName, 1, 5)...)
+}
+
+// entsoeDocument is an A75 (actual generation per production type) GL_MarketDocument, or the
+// Acknowledgement_MarketDocument that is returned instead when there is no data.
+type entsoeDocument struct {
+	XMLName    xml.Name
+	TimeSeries []struct {
+		InBiddingZone string `xml:"inBiddingZone_Domain.mRID"`
+		PSRType       string `xml:"MktPSRType>psrType"`
+		Period        []struct {
+			Start      string `xml:"timeInterval>start"`
+			End        string `xml:"timeInterval>end"`
+			Resolution string `xml:"resolution"`
+			Points     []struct {
+				Position int     `xml:"position"`
+				Quantity float64 `xml:"quantity"`
+			} `xml:"Point"`
+		} `xml:"Period"`
+	} `xml:"TimeSeries"`
+	Reason []struct {
+		Code string `xml:"code"`
+		Text string `xml:"text"`
+	} `xml:"Reason"`
+}
+
+// EntsoeDataProvider is an implementation of the IDataSource that uses the ENTSO-E Transparency Platform, which is
+// free and covers the European bidding zones. It reads the actual generation per production type (A75 documents)
+// of a zone and calculates the carbon intensity of the generation from a table of emission factors per production
+// type. Readings have the same schema as CO2 Signal's.
+type EntsoeDataProvider struct {
+	client          *httpClient
+	registry        *zones.Registry
+	baseURL         string
+	securityToken   string
+	biddingZones    map[string]string
+	emissionFactors map[string]float64 // gCO2eq/kWh by production type, e.g. B04 for gas.
+}
+
+// Initialise reads the security token from the environment, and the settings and emission factors from the
+// configuration files.
+func (r *EntsoeDataProvider) Initialise() {
+	val, ok := os.LookupEnv(entsoeEnvVarName)
+	if !ok || val == "" {
+		log.Fatalf("EntsoeDataProvider::Initialise(). Security-token environment variable (%s) not set.", entsoeEnvVarName)
+	}
+	r.securityToken = val
+
+	appConfig := config.App()
+	r.baseURL = appConfig.String(entsoeURLConfigItem)
+
+	extra, err := parseBiddingZones(appConfig.List(entsoeBiddingZonesConfigItem))
+	if err != nil {
+		log.Fatalf("EntsoeDataProvider::Initialise(): %v", err)
+	}
+	r.biddingZones = make(map[string]string, len(entsoeBiddingZones)+len(extra))
+	for zone, eic := range entsoeBiddingZones {
+		r.biddingZones[zone] = eic
+	}
+	for zone, eic := range extra {
+		r.biddingZones[zone] = eic
+	}
+
+	factorsFile := appConfig.String(entsoeEmissionFactorsConfigItem)
+	r.emissionFactors, err = loadEmissionFactors(factorsFile)
+	if err != nil {
+		log.Fatalf("EntsoeDataProvider::Initialise(): Failed to load the emission factors: %v", err)
+	}
+
+	r.client = newHTTPClient(newRateLimiter(entsoeSourceName))
+
+	log.Printf("EntsoeDataProvider::Initialise(): url=%s zones=%d emission-factors=%s", r.baseURL, len(r.biddingZones), factorsFile)
+}
+
+// SetZoneRegistry assigns the registry that provides the country and zone names added to each reading.
+func (r *EntsoeDataProvider) SetZoneRegistry(registry *zones.Registry) {
+	r.registry = registry
+}
+
+// GetAvailableZones returns the zones that have a bidding zone.
+func (r *EntsoeDataProvider) GetAvailableZones(ctx context.Context) ([]string, error) {
+	zoneList := make([]string, 0, len(r.biddingZones))
+	for zone := range r.biddingZones {
+		zoneList = append(zoneList, zone)
+	}
+	sort.Strings(zoneList)
+
+	return zoneList, nil
+}
+
+// GetCarbonIntensity retrieves the recent generation of the zone and calculates the carbon intensity at the latest
+// time every production type has reported.
+// https://web-api.tp.entsoe.eu/api?documentType=A75&processType=A16&in_Domain=10YFR-RTE------C&periodStart=...
+func (r *EntsoeDataProvider) GetCarbonIntensity(ctx context.Context, zone string) ([]DataSourceDetails, error) {
+	log.Printf("EntsoeDataProvider::GetCarbonIntensity(%s)", zone)
+
+	eic, ok := r.biddingZones[zone]
+	if !ok {
+		return nil, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no bidding zone. Add one with %s", entsoeBiddingZonesConfigItem))
+	}
+
+	end := time.Now().UTC().Truncate(time.Hour).Add(time.Hour)
+	query := url.Values{}
+	query.Set("securityToken", r.securityToken)
+	query.Set("documentType", "A75")
+	query.Set("processType", "A16") // Realised.
+	query.Set("in_Domain", eic)
+	query.Set("periodStart", end.Add(-entsoeLookback).Format(entsoeParamFormat))
+	query.Set("periodEnd", end.Format(entsoeParamFormat))
+
+	responseData, err := r.client.get(ctx, zone, r.baseURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	generation, err := parseEntsoeGeneration(zone, responseData)
+	if err != nil {
+		return nil, err
+	}
+
+	reading, err := intensityFromGeneration(zone, generation, r.emissionFactors, entsoeFossilTypes)
+	if err != nil {
+		return nil, err
+	}
+	describeZone(r.registry, &reading)
+
+	msg, err := json.Marshal(reading)
+	if err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	log.Printf("Parsed Response: %s : %s\n", reading.Key, msg)
+
+	return []DataSourceDetails{{Key: reading.Key, Datetime: reading.Datetime, Source: entsoeSourceName, ProviderResp: string(msg)}}, nil
+}
+
+// parseEntsoeGeneration parses an A75 document into the generation, in MW, of each production type at each time.
+// Only generation in the zone is counted, not the consumption of pumped storage. A point that is left out of a
+// period has the same quantity as the point before it. Returns an ErrZoneUnsupported error if the document is an
+// acknowledgement that there is no data, or an ErrMalformedPayload error if it cannot be parsed.
+func parseEntsoeGeneration(zone string, data []byte) (generationMix, error) {
+	var doc entsoeDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	if doc.XMLName.Local == "Acknowledgement_MarketDocument" {
+		for _, reason := range doc.Reason {
+			if reason.Code == entsoeNoDataReason {
+				return nil, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("%s", reason.Text))
+			}
+		}
+		return nil, newSourceError(ErrUpstream, zone, 0, fmt.Errorf("request not acknowledged: %v", doc.Reason))
+	}
+
+	generation := make(generationMix)
+	for _, series := range doc.TimeSeries {
+		if series.InBiddingZone == "" || series.PSRType == "" {
+			continue
+		}
+
+		for _, period := range series.Period {
+			start, err1 := time.Parse(entsoeDatetimeFormat, period.Start)
+			end, err2 := time.Parse(entsoeDatetimeFormat, period.End)
+			resolution, err3 := parseResolution(period.Resolution)
+			if err1 != nil || err2 != nil || err3 != nil {
+				return nil, newSourceError(ErrMalformedPayload, zone, 0,
+					fmt.Errorf("invalid period %s to %s with resolution %s", period.Start, period.End, period.Resolution))
+			}
+
+			quantities := make(map[int]float64, len(period.Points))
+			for _, point := range period.Points {
+				quantities[point.Position] = point.Quantity
+			}
+
+			if generation[series.PSRType] == nil {
+				generation[series.PSRType] = make(map[time.Time]float64)
+			}
+			var quantity float64
+			for position, at := 1, start; at.Before(end); position, at = position+1, at.Add(resolution) {
+				if q, ok := quantities[position]; ok {
+					quantity = q
+				} else if position == 1 {
+					break
+				}
+				generation[series.PSRType][at] += quantity
+			}
+		}
+	}
+
+	if len(generation) == 0 {
+		return nil, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no generation"))
+	}
+
+	return generation, nil
+}
+
+// parseResolution converts a resolution such as PT15M or PT1H to a duration.
+func parseResolution(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(strings.ToLower(strings.TrimPrefix(value, "PT")))
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("unsupported resolution %s", value)
+	}
+
+	return d, nil
+}
+
+// parseBiddingZones parses a list of zone:EIC code, e.g. IT-NO:10Y1001A1001A73I.
+func parseBiddingZones(list []string) (map[string]string, error) {
+	biddingZones := make(map[string]string)
+	for _, entry := range list {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 2 || parts[0] == "" || len(parts[1]) != 16 {
+			return nil, fmt.Errorf("%s is not zone:EIC code", entry)
+		}
+		biddingZones[parts[0]] = parts[1]
+	}
+
+	return biddingZones, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// entsoeTime returns a time on the day of the ENTSO-E fixtures.
+func entsoeTime(hour, minute int) time.Time {
+	return time.Date(2022, 10, 17, hour, minute, 0, 0, time.UTC)
+}
+
+func TestParseEntsoeGeneration(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		want    generationMix
+		wantErr error
+	}{
+		{
+			// The pumped storage consumption is out of the zone, so it is not counted.
+			name:    "hourly resolution",
+			fixture: "entsoe-a75-pt60m.xml",
+			want: generationMix{
+				"B04": {entsoeTime(10, 0): 12010, entsoeTime(11, 0): 12234, entsoeTime(12, 0): 11876},
+				"B19": {entsoeTime(10, 0): 20500, entsoeTime(11, 0): 21012, entsoeTime(12, 0): 22480},
+			},
+		},
+		{
+			// Solar leaves out positions 2 and 4, which have the quantity of the position before them.
+			name:    "quarter-hourly resolution with omitted positions",
+			fixture: "entsoe-a75-pt15m.xml",
+			want: generationMix{
+				"B04": {entsoeTime(10, 0): 3010, entsoeTime(10, 15): 3025, entsoeTime(10, 30): 3040, entsoeTime(10, 45): 3052},
+				"B16": {entsoeTime(10, 0): 8120, entsoeTime(10, 15): 8120, entsoeTime(10, 30): 8305, entsoeTime(10, 45): 8305},
+			},
+		},
+		{name: "no data", fixture: "entsoe-acknowledgement-no-data.xml", wantErr: ErrZoneUnsupported},
+		{name: "not acknowledged", fixture: "entsoe-acknowledgement-rejected.xml", wantErr: ErrUpstream},
+		{name: "unsupported resolution", fixture: "entsoe-a75-bad-resolution.xml", wantErr: ErrMalformedPayload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := parseEntsoeGeneration("DE", data)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("parseEntsoeGeneration() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseEntsoeGeneration() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseEntsoeGeneration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEntsoeGenerationNotXML(t *testing.T) {
+	if _, err := parseEntsoeGeneration("DE", []byte("Service unavailable")); !errors.Is(err, ErrMalformedPayload) {
+		t.Errorf("parseEntsoeGeneration() error = %v, want %v", err, ErrMalformedPayload)
+	}
+}
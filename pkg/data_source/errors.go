@@ -0,0 +1,115 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kinds of error a data source can return. Use errors.Is to test for them.
+var (
+	ErrRateLimited      = errors.New("rate limited")
+	ErrQuotaExhausted   = errors.New("daily quota exhausted")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrZoneUnsupported  = errors.New("zone unsupported")
+	ErrUpstream         = errors.New("upstream error")
+	ErrMalformedPayload = errors.New("malformed payload")
+)
+
+// The maximum number of characters of a response body that is included in an error.
+const maxErrorBodyLength = 200
+
+// SourceError describes a failed request to a data source. Kind is one of the Err* values above.
+type SourceError struct {
+	Kind       error
+	Zone       string // The zone that was requested. Empty if the request was not for a zone.
+	StatusCode int    // The HTTP status code, or 0 if no response was received.
+	Err        error  // The underlying cause, if there is one.
+}
+
+func (e *SourceError) Error() string {
+	msg := e.Kind.Error()
+	if e.Zone != "" {
+		msg += " for zone " + e.Zone
+	}
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(" (HTTP %d)", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+
+	return msg
+}
+
+// Is reports whether the target is the kind of this error, so errors.Is(err, ErrRateLimited) works.
+func (e *SourceError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// Unwrap returns the underlying cause.
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// newSourceError is a convenience function for creating a SourceError.
+func newSourceError(kind error, zone string, statusCode int, err error) *SourceError {
+	return &SourceError{Kind: kind, Zone: zone, StatusCode: statusCode, Err: err}
+}
+
+// errorFromStatus maps an HTTP status code to a SourceError. Returns nil for a 2xx status.
+func errorFromStatus(zone string, statusCode int, body string) error {
+	var kind error
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		return nil
+	case statusCode == 401 || statusCode == 403:
+		kind = ErrUnauthorized
+	case statusCode == 429:
+		kind = ErrRateLimited
+	case statusCode == 400 || statusCode == 404:
+		kind = ErrZoneUnsupported
+	default:
+		kind = ErrUpstream
+	}
+
+	// Keep enough of the body to explain the error without flooding the log.
+	var err error
+	if len(body) > maxErrorBodyLength {
+		body = body[:maxErrorBodyLength] + "..."
+	}
+	if body != "" {
+		err = errors.New(body)
+	}
+
+	return newSourceError(kind, zone, statusCode, err)
+}
+
+// IsRetryable returns true if the error is likely to be transient, so the request is worth trying again.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrUpstream)
+}
+
+// IsQuotaExhausted returns true if no more requests can be made to the data source until the quota resets.
+func IsQuotaExhausted(err error) bool {
+	return errors.Is(err, ErrQuotaExhausted)
+}
+
+// IsFatal returns true if the error will affect every request to the data source, so there is no point
+// requesting any further zones.
+func IsFatal(err error) bool {
+	return errors.Is(err, ErrUnauthorized)
+}
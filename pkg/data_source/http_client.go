@@ -0,0 +1,187 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/retry"
+)
+
+// Configuration items for the HTTP client shared by the data sources. All values are in seconds except the retries.
+const (
+	httpTimeoutConfigItem    = "http-timeout"     // Deadline for each request, including reading the response.
+	httpMaxRetriesConfigItem = "http-max-retries" // Number of times a failed request is retried.
+	httpMaxBackoffConfigItem = "http-max-backoff" // Longest wait between retries.
+)
+
+// Defaults used if the configuration file does not set the HTTP client items.
+const (
+	defaultHTTPTimeout    = "30"
+	defaultHTTPMaxRetries = "3"
+	defaultHTTPMaxBackoff = "60"
+)
+
+// httpClientConfigItems returns the configuration items used by the HTTP client.
+func httpClientConfigItems() []config.Item {
+	return []config.Item{
+		{Key: httpTimeoutConfigItem, Kind: config.KindInt, Default: defaultHTTPTimeout, Check: config.AtLeast(1)},
+		{Key: httpMaxRetriesConfigItem, Kind: config.KindInt, Default: defaultHTTPMaxRetries, Check: config.AtLeast(0)},
+		{Key: httpMaxBackoffConfigItem, Kind: config.KindInt, Default: defaultHTTPMaxBackoff, Check: config.AtLeast(1)},
+	}
+}
+
+// The wait before the first retry. It doubles on each subsequent retry up to the maximum backoff.
+const httpBaseBackoff = time.Second
+
+// Query parameters that hold a data source's credentials. Their values are redacted from the URLs in log
+// messages and errors.
+var credentialParams = []string{"securityToken", "api_key"}
+
+// The value that replaces a credential in a redacted URL. It is the same as url.URL.Redacted uses for passwords.
+const redactedValue = "xxxxx"
+
+// httpClient sends requests to a data source's web service. Requests are bound to a context so they are
+// cancelled on shutdown, each has its own deadline, and 429 and 5xx responses are retried with jittered
+// exponential backoff that honours any Retry-After header. Every attempt, including retries, waits for the
+// data source's rate limiter.
+type httpClient struct {
+	client     http.Client
+	limiter    *rateLimiter
+	timeout    time.Duration
+	maxRetries int
+	maxBackoff time.Duration
+}
+
+// newHTTPClient creates an httpClient using the settings in the application configuration file.
+func newHTTPClient(limiter *rateLimiter) *httpClient {
+	return &httpClient{
+		limiter:    limiter,
+		timeout:    time.Duration(config.App().Int(httpTimeoutConfigItem)) * time.Second,
+		maxRetries: config.App().Int(httpMaxRetriesConfigItem),
+		maxBackoff: time.Duration(config.App().Int(httpMaxBackoffConfigItem)) * time.Second,
+	}
+}
+
+// get sends a GET request and returns the response body. Errors are returned as a *SourceError, except that the
+// context's error is returned if it is cancelled while waiting for the rate limiter or to retry. The zone is only
+// used to describe the error and can be empty.
+func (c *httpClient) get(ctx context.Context, zone string, rawURL string, headers map[string]string) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		body, retryAfter, err := c.getOnce(ctx, zone, rawURL, headers)
+		if err == nil || !IsRetryable(err) || attempt >= c.maxRetries {
+			return body, err
+		}
+
+		delay := retry.Backoff(httpBaseBackoff, c.maxBackoff, attempt)
+		if retryAfter > 0 {
+			if retryAfter > c.maxBackoff {
+				// The data source wants us to wait longer than we are prepared to, so give up now.
+				return nil, err
+			}
+			delay = retryAfter
+		}
+
+		log.Printf("WARNING: Request to %s failed, retrying in %v: %v", redactURL(rawURL), delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// getOnce sends a single GET request with its own deadline. It returns the body, the delay requested by any
+// Retry-After header, and an error if the request failed. Credentials are redacted from the URL in the error.
+func (c *httpClient) getOnce(ctx context.Context, zone string, rawURL string, headers map[string]string) ([]byte, time.Duration, error) {
+	if err := c.limiter.Wait(ctx, zone); err != nil {
+		return nil, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, 0, newSourceError(ErrUpstream, zone, 0, redactError(err))
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+
+	response, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, newSourceError(ErrUpstream, zone, 0, redactError(err))
+	}
+	defer response.Body.Close()
+
+	responseData, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, 0, newSourceError(ErrUpstream, zone, response.StatusCode, err)
+	}
+
+	if err := errorFromStatus(zone, response.StatusCode, string(responseData)); err != nil {
+		return nil, retry.ParseRetryAfter(response.Header.Get("Retry-After")), err
+	}
+
+	return responseData, 0, nil
+}
+
+// redactURL replaces the values of the credentials in a URL's query, so the URL can be logged. If the URL cannot
+// be parsed its whole query is removed.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		if i := strings.IndexByte(rawURL, '?'); i >= 0 {
+			return rawURL[:i]
+		}
+		return rawURL
+	}
+
+	query := u.Query()
+	redacted := false
+	for _, param := range credentialParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, redactedValue)
+			redacted = true
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+
+	return u.Redacted()
+}
+
+// redactError redacts the credentials from the URL of a *url.Error, which the http package returns for failed
+// requests.
+func redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redactURL(urlErr.URL)
+	}
+
+	return err
+}
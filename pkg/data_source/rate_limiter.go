@@ -0,0 +1,158 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// Suffixes of the rate-limit configuration items. Each data source prefixes them with its name,
+// e.g. co2-signal-requests-per-second.
+const (
+	requestsPerSecondConfigItem = "-requests-per-second" // Sustained rate requests can be made at.
+	burstConfigItem             = "-burst"               // Number of requests that can be made at once after a quiet period.
+	dailyQuotaConfigItem        = "-daily-quota"         // Number of requests allowed per UTC day. 0 is unlimited.
+)
+
+// QuotaStore persists the number of requests each data source has made per UTC day, so a daily quota holds
+// across runs. The checkpoint store implements it.
+type QuotaStore interface {
+	// QuotaUsed returns the number of requests a data source has made on a UTC day.
+	QuotaUsed(source string, day string) int
+
+	// RecordQuotaUsed records the number of requests a data source has made on a UTC day.
+	RecordQuotaUsed(source string, day string, used int) error
+}
+
+// quotaStore persists the daily quota usage of the rate limiters. If it is nil the usage is only held in memory
+// and every run of the service starts with the whole quota.
+var quotaStore QuotaStore
+
+// SetQuotaStore assigns the store the daily quota usage is persisted in. It must be called before the data source
+// is initialised.
+func SetQuotaStore(store QuotaStore) {
+	quotaStore = store
+}
+
+// rateLimiter is a token bucket that limits the requests a data source makes to its web service. The bucket
+// holds up to burst tokens and refills at the configured rate. A daily quota, if set, caps the total
+// number of requests per UTC day. The limiter is safe to share between goroutines.
+type rateLimiter struct {
+	mutex      sync.Mutex
+	source     string
+	store      QuotaStore
+	rate       float64 // Tokens added per second. 0 disables the rate limit.
+	burst      float64
+	tokens     float64
+	last       time.Time
+	dailyQuota int
+	used       int
+	day        string // The UTC day the used count applies to.
+}
+
+// rateLimitConfigItems returns the rate-limit configuration items for the named data source.
+func rateLimitConfigItems(sourceName string, defaultRate float64, defaultBurst int) []config.Item {
+	return []config.Item{
+		{Key: sourceName + requestsPerSecondConfigItem, Kind: config.KindFloat,
+			Default: strconv.FormatFloat(defaultRate, 'g', -1, 64), Check: config.AtLeast(0)},
+		{Key: sourceName + burstConfigItem, Kind: config.KindInt, Default: strconv.Itoa(defaultBurst), Check: config.AtLeast(1)},
+		{Key: sourceName + dailyQuotaConfigItem, Kind: config.KindInt, Default: "0", Check: config.AtLeast(0)},
+	}
+}
+
+// newRateLimiter creates a rate limiter from the configuration items for the named data source.
+func newRateLimiter(sourceName string) *rateLimiter {
+	l := &rateLimiter{
+		source:     sourceName,
+		store:      quotaStore,
+		rate:       config.App().Float(sourceName + requestsPerSecondConfigItem),
+		burst:      float64(config.App().Int(sourceName + burstConfigItem)),
+		dailyQuota: config.App().Int(sourceName + dailyQuotaConfigItem),
+		last:       time.Now(),
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.tokens = l.burst
+
+	log.Printf("Rate limit for %s: %g requests/second, burst %g, daily quota %d", sourceName, l.rate, l.burst, l.dailyQuota)
+
+	return l
+}
+
+// Wait blocks until a request can be made. It returns an ErrQuotaExhausted error if the daily quota has been
+// used, or the context's error if it is cancelled while waiting.
+func (l *rateLimiter) Wait(ctx context.Context, zone string) error {
+	for {
+		delay, err := l.reserve(zone)
+		if err != nil || delay == 0 {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes a token if one is available. Otherwise it returns how long until one will be.
+func (l *rateLimiter) reserve(zone string) (time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	if l.dailyQuota > 0 {
+		if today := now.UTC().Format("2006-01-02"); today != l.day {
+			l.day, l.used = today, 0
+			if l.store != nil {
+				l.used = l.store.QuotaUsed(l.source, today)
+			}
+		}
+		if l.used >= l.dailyQuota {
+			return 0, newSourceError(ErrQuotaExhausted, zone, 0, nil)
+		}
+	}
+
+	if l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+
+		if l.tokens < 1 {
+			return time.Duration((1 - l.tokens) / l.rate * float64(time.Second)), nil
+		}
+		l.tokens--
+	}
+
+	l.used++
+	if l.dailyQuota > 0 && l.store != nil {
+		if err := l.store.RecordQuotaUsed(l.source, l.day, l.used); err != nil {
+			log.Printf("WARNING: Failed to record the daily quota used by %s: %v", l.source, err)
+		}
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestRateLimiter returns a limiter with a full bucket and no daily quota.
+func newTestRateLimiter(rate float64, burst float64) *rateLimiter {
+	return &rateLimiter{source: "test", rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// memoryQuotaStore is a QuotaStore that holds the usage in memory.
+type memoryQuotaStore map[string]int
+
+func (s memoryQuotaStore) QuotaUsed(source string, day string) int {
+	return s[source+"/"+day]
+}
+
+func (s memoryQuotaStore) RecordQuotaUsed(source string, day string, used int) error {
+	s[source+"/"+day] = used
+	return nil
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newTestRateLimiter(10, 3)
+
+	for i := 0; i < 3; i++ {
+		if delay, err := l.reserve("DE"); delay != 0 || err != nil {
+			t.Fatalf("request %d: delay = %v, error = %v, want no wait", i+1, delay, err)
+		}
+	}
+
+	// The bucket is empty, so the next token is a tenth of a second away.
+	delay, err := l.reserve("DE")
+	if err != nil || delay <= 0 || delay > 100*time.Millisecond {
+		t.Errorf("request 4: delay = %v, error = %v, want up to 100ms", delay, err)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newTestRateLimiter(10, 3)
+	for i := 0; i < 3; i++ {
+		l.reserve("DE")
+	}
+
+	// 250ms at 10 requests a second refills two tokens. The time is moved back so the test does not sleep.
+	l.last = l.last.Add(-250 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if delay, err := l.reserve("DE"); delay != 0 || err != nil {
+			t.Fatalf("request %d after the refill: delay = %v, error = %v, want no wait", i+1, delay, err)
+		}
+	}
+	if delay, _ := l.reserve("DE"); delay == 0 {
+		t.Error("request 3 after the refill did not wait")
+	}
+
+	// The bucket never holds more than the burst, however long it has been idle.
+	l.last = l.last.Add(-time.Hour)
+	for i := 0; i < 3; i++ {
+		l.reserve("DE")
+	}
+	if delay, _ := l.reserve("DE"); delay == 0 {
+		t.Error("an idle bucket held more than the burst")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := newTestRateLimiter(20, 1)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.Wait(context.Background(), "DE"); err != nil {
+			t.Fatalf("Wait() error = %v", err)
+		}
+	}
+
+	// The first request uses the burst and each of the others waits 50ms for a token.
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("3 requests took %v, want at least 100ms", elapsed)
+	}
+}
+
+func TestRateLimiterWaitCancelled(t *testing.T) {
+	tests := []struct {
+		name    string
+		context func() (context.Context, context.CancelFunc)
+		want    error
+	}{
+		{
+			name: "cancelled",
+			context: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			want: context.Canceled,
+		},
+		{
+			name: "deadline",
+			context: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 20*time.Millisecond)
+			},
+			want: context.DeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// One request an hour, so once the burst is used Wait can only return because of the context.
+			l := newTestRateLimiter(1.0/3600, 1)
+			if err := l.Wait(context.Background(), "DE"); err != nil {
+				t.Fatalf("first Wait() error = %v", err)
+			}
+
+			ctx, cancel := tt.context()
+			defer cancel()
+
+			start := time.Now()
+			err := l.Wait(ctx, "DE")
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Wait() error = %v, want %v", err, tt.want)
+			}
+			if errors.Is(err, ErrUpstream) || IsRetryable(err) {
+				t.Errorf("Wait() error = %v is reported as an upstream error", err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Wait() returned after %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestRateLimiterDailyQuota(t *testing.T) {
+	today := time.Now().UTC().Format("2006-01-02")
+	store := memoryQuotaStore{"test/" + today: 8}
+
+	// The previous run used 8 of the 10 requests allowed today.
+	l := newTestRateLimiter(0, 1)
+	l.dailyQuota = 10
+	l.store = store
+
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(context.Background(), "DE"); err != nil {
+			t.Fatalf("request %d: Wait() error = %v", i+1, err)
+		}
+	}
+	if err := l.Wait(context.Background(), "DE"); !errors.Is(err, ErrQuotaExhausted) {
+		t.Errorf("Wait() error = %v, want %v", err, ErrQuotaExhausted)
+	}
+	if used := store["test/"+today]; used != 10 {
+		t.Errorf("recorded usage = %d, want 10", used)
+	}
+}
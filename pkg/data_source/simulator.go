@@ -15,75 +15,171 @@
 package data_source
 
 import (
-	"fmt"
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"math"
 	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
 )
 
-// Simulator is an implementation of the IMarketDataSource. This implementation is used
-// for implementing demonstrations of market rates without the need for a live connection to a market data source.
-type Simulator struct {
+// Configuration item that holds the seed for the simulator's random source. If it is not set, or is zero,
+// the simulator is seeded from the clock and produces different readings on every run.
+const simulatorSeedConfigItem = "simulator-seed"
+
+// simulatorConfigItems returns the configuration items used by the simulator.
+func simulatorConfigItems() []config.Item {
+	return []config.Item{
+		{Key: simulatorSeedConfigItem, Kind: config.KindInt},
+	}
 }
 
-// The  structure that dummy market data should be returned in.
-type mockProviderResponse struct {
-	Currency     string  `json:"currency"`
-	BaseCurrency string  `json:"base_currency"`
-	Ask          float32 `json:"ask"`
-	Bid          float32 `json:"bid"`
-	Date         string  `json:"date"`
-	HighAsk      float32 `json:"high_ask"`
-	HighBid      float32 `json:"high_bid"`
-	LowAsk       float32 `json:"low_ask"`
-	LowBid       float32 `json:"low_bid"`
-	Midpoint     float32 `json:"midpoint"`
+const simulatorSourceName = "simulator"
+
+// The format CO2 Signal uses for the datetime of a reading.
+const co2SignalDatetimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Zones returned by GetAvailableZones. The simulator will produce readings for any zone it is asked for.
+var simulatedZones = []string{"AUS-NSW", "AUS-SA", "AUS-VIC", "DE", "DK-DK1", "ES", "FR", "GB", "NZ", "US-CAL-CISO", "US-MIDA-PJM", "US-NW-BPAT"}
+
+// Approximate UTC offsets, in hours, used to place the solar and wind curves in the zone's local day.
+// The longest matching zone prefix wins. Zones that do not match are assumed to be in central Europe.
+var zoneUTCOffsets = map[string]float64{
+	"AUS": 10, "AUS-SA": 9.5, "AUS-WA": 8, "NZ": 12, "JP": 9, "KR": 9, "CN": 8, "SG": 8, "IN": 5.5,
+	"GB": 0, "IE": 0, "PT": 0, "IS": 0, "BR": -3, "AR": -3, "CL": -4, "MX": -6, "CA": -5,
+	"US": -6, "US-AK": -9, "US-HI": -10, "US-CAL": -8, "US-NW": -8, "US-SW": -7,
+	"US-CAR": -5, "US-FLA": -5, "US-MIDA": -5, "US-NE": -5, "US-NY": -5, "US-SE": -5, "US-TEN": -5,
 }
 
-var dummyPrice mockProviderResponse
+// Lifecycle emission factors (gCO2eq/kWh) for the generation types the simulator models.
+const (
+	solarEmissionFactor     = 45
+	windEmissionFactor      = 11
+	lowCarbonEmissionFactor = 15 // Hydro and nuclear.
+)
 
-var defaultFX = map[string]float32{"AUD": 0.69373, "CAD": 0.77616, "EUR": 1.02166, "JPY": 0.00733, "NZD": 0.62524, "NOK": 0.10117, "GBP": 1.20256, "SEK": 0.09804, "CHF": 1.03716}
+// Simulator is an implementation of the IDataSource. This implementation is used for demonstrations and
+// integration tests of the pipeline without the need for a live connection (or API key) to a data source.
+// Readings have the same shape as CO2 Signal's, so config/simulator-trino-schema.json describes them.
+type Simulator struct {
+	mutex    sync.Mutex
+	random   *rand.Rand
+	registry *zones.Registry
+}
 
-func (r *Simulator) Initialise() {
-	// Set up the standard dataset for the simulation
-	dummyPrice.BaseCurrency = "undefined"
-	dummyPrice.Currency = "undefined"
-	dummyPrice.Ask = 0.72894
-	dummyPrice.Bid = 0.72890
-	dummyPrice.HighAsk = 0
-	dummyPrice.HighBid = 0
-	dummyPrice.LowAsk = 0
-	dummyPrice.LowBid = 0
-	dummyPrice.Midpoint = 0
+// zoneProfile describes the generation mix of a simulated zone.
+type zoneProfile struct {
+	utcOffset       float64 // Hours from UTC, used to find the local time of day.
+	fossilIntensity float64 // gCO2eq/kWh of the zone's fossil generation.
+	lowCarbonShare  float64 // Fraction of demand met by hydro and nuclear. Constant over the day.
+	solarCapacity   float64 // Fraction of demand met by solar at solar noon on a clear day.
+	windCapacity    float64 // Average fraction of demand met by wind.
+	windPeakHour    float64 // Local hour at which the wind tends to be strongest.
 }
 
-func (r *Simulator) GetCarbonIntensity(countryCode string) []DataSourceDetails {
-	fmt.Println("GetCO2() requested for MarketSimulator")
+// Initialise sets up the random source from the configuration file.
+func (r *Simulator) Initialise() {
+	seed := int64(config.App().Int(simulatorSeedConfigItem))
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("Simulator::Initialise(): seed=%d", seed)
+
+	r.random = rand.New(rand.NewSource(seed))
+}
 
-	var mockResponses []DataSourceDetails
+// SetZoneRegistry assigns the registry that provides the country and zone names added to each reading.
+func (r *Simulator) SetZoneRegistry(registry *zones.Registry) {
+	r.registry = registry
+}
 
-	return mockResponses
+// GetAvailableZones returns a representative list of zones from around the world.
+func (r *Simulator) GetAvailableZones(ctx context.Context) ([]string, error) {
+	return simulatedZones, nil
 }
 
-func (r *Simulator) simulateCO2(currency string) {
+// GetCarbonIntensity simulates the carbon intensity of electricity for the current hour in the given zone.
+func (r *Simulator) GetCarbonIntensity(ctx context.Context, zone string) ([]DataSourceDetails, error) {
+	log.Printf("Simulator::GetCarbonIntensity(%s)", zone)
+
+	reading := r.simulateCO2(zone, time.Now().UTC().Truncate(time.Hour))
+	describeZone(r.registry, &reading)
 
-	ask, ok := defaultFX[currency]
-	if !ok {
-		ask = 0.75
+	msg, err := json.Marshal(reading)
+	if err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
 	}
 
-	dummyPrice.Ask = ask + (rand.Float32()-0.5)/100
-	dummyPrice.Bid = dummyPrice.Ask - 0.00002
+	return []DataSourceDetails{{Key: reading.Key, Datetime: reading.Datetime, Source: simulatorSourceName, ProviderResp: string(msg)}}, nil
+}
 
-	if dummyPrice.Bid > dummyPrice.HighBid || dummyPrice.HighBid == 0 {
-		dummyPrice.HighBid = dummyPrice.Bid
+// simulateCO2 models the zone's generation mix at the given time. Solar follows a half-sine between 06:00 and
+// 18:00 local time, scaled by random cloud cover. Wind follows a daily cycle around the zone's average with
+// random gusts. Hydro and nuclear are constant and fossil generation makes up the remainder.
+func (r *Simulator) simulateCO2(zone string, at time.Time) co2SignalProviderResponse {
+	profile := newZoneProfile(zone)
+	localHour := math.Mod(float64(at.Hour())+float64(at.Minute())/60+profile.utcOffset+24, 24)
+
+	r.mutex.Lock()
+	cloudCover := 0.6 + 0.4*r.random.Float64()
+	gusts := 0.7 + 0.6*r.random.Float64()
+	r.mutex.Unlock()
+
+	solar := profile.solarCapacity * math.Max(0, math.Sin(math.Pi*(localHour-6)/12)) * cloudCover
+	wind := profile.windCapacity * (1 + 0.4*math.Cos(2*math.Pi*(localHour-profile.windPeakHour)/24)) * gusts
+
+	// Keep a minimum of fossil generation on the grid for system stability.
+	lowCarbon := profile.lowCarbonShare
+	if renewable := solar + wind + lowCarbon; renewable > 0.98 {
+		solar, wind, lowCarbon = solar*0.98/renewable, wind*0.98/renewable, lowCarbon*0.98/renewable
 	}
-	if dummyPrice.Ask > dummyPrice.HighAsk || dummyPrice.HighAsk == 0 {
-		dummyPrice.HighAsk = dummyPrice.Ask
+	fossil := 1 - solar - wind - lowCarbon
+
+	intensity := fossil*profile.fossilIntensity + solar*solarEmissionFactor + wind*windEmissionFactor + lowCarbon*lowCarbonEmissionFactor
+
+	return co2SignalProviderResponse{
+		Key:                  zone,
+		CountryCode:          zone,
+		Status:               "ok",
+		Datetime:             at.Format(co2SignalDatetimeFormat),
+		CarbonIntensity:      math.Round(intensity),
+		FosselFuelPercentage: math.Round(fossil*10000) / 100,
+		UnitName:             "carbonIntensity",
+		UnitValue:            "gCO2eq/kWh",
 	}
-	if dummyPrice.Ask < dummyPrice.LowAsk || dummyPrice.LowAsk == 0 {
-		dummyPrice.LowAsk = dummyPrice.Ask
+}
+
+// newZoneProfile derives a generation mix for a zone from a hash of its name, so each zone is different
+// but the same zone always has the same mix regardless of the random seed.
+func newZoneProfile(zone string) zoneProfile {
+	h := fnv.New64a()
+	h.Write([]byte(zone))
+	zoneRand := rand.New(rand.NewSource(int64(h.Sum64())))
+
+	return zoneProfile{
+		utcOffset:       utcOffset(zone),
+		fossilIntensity: 450 + 500*zoneRand.Float64(),
+		lowCarbonShare:  0.5 * zoneRand.Float64(),
+		solarCapacity:   0.05 + 0.35*zoneRand.Float64(),
+		windCapacity:    0.05 + 0.25*zoneRand.Float64(),
+		windPeakHour:    24 * zoneRand.Float64(),
 	}
-	if dummyPrice.Bid < dummyPrice.LowBid || dummyPrice.LowBid == 0 {
-		dummyPrice.LowBid = dummyPrice.Bid
+}
+
+// utcOffset returns the approximate UTC offset for a zone using the longest matching prefix.
+func utcOffset(zone string) float64 {
+	offset, matched := 1.0, ""
+	for prefix, o := range zoneUTCOffsets {
+		if (zone == prefix || strings.HasPrefix(zone, prefix+"-")) && len(prefix) > len(matched) {
+			offset, matched = o, prefix
+		}
 	}
-	dummyPrice.Midpoint = dummyPrice.Bid + (dummyPrice.Ask - dummyPrice.Bid)
+
+	return offset
 }
@@ -0,0 +1,356 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
+)
+
+// Configuration items for the UK Carbon Intensity data source.
+const (
+	ukCarbonIntensityURLConfigItem      = "uk-carbon-intensity-url"      // Base URL of the API.
+	ukCarbonIntensityForecastConfigItem = "uk-carbon-intensity-forecast" // Add the 48-hour forecast to each reading.
+)
+
+// Defaults used if the configuration file does not set the UK Carbon Intensity items.
+const (
+	defaultUKCarbonIntensityURL      = "https://api.carbonintensity.org.uk"
+	defaultUKCarbonIntensityForecast = "true"
+)
+
+const ukCarbonIntensitySourceName string = "uk-carbon-intensity"
+
+// Zone keys are this prefix followed by the API's region ID, e.g. GB-REG-13 is London.
+const ukRegionZonePrefix = "GB-REG-"
+
+// The region that covers the whole of Great Britain. It is the only region with an actual intensity.
+const ukNationalRegionID = 18
+
+// The format the API uses for the start and end of each half-hour period.
+const ukCarbonIntensityDatetimeFormat = "2006-01-02T15:04Z"
+
+// Fuels in the generation mix that are counted as fossil fuels.
+var ukFossilFuels = []string{"coal", "gas", "oil"}
+
+// ukCarbonIntensityConfigItems returns the configuration items used by the UK Carbon Intensity API. The API has
+// no published rate limit, so the default is modest.
+func ukCarbonIntensityConfigItems() []config.Item {
+	items := []config.Item{
+		{Key: ukCarbonIntensityURLConfigItem, Kind: config.KindString, Default: defaultUKCarbonIntensityURL},
+		{Key: ukCarbonIntensityForecastConfigItem, Kind: config.KindBool, Default: defaultUKCarbonIntensityForecast},
+	}
+
+	return append(items, rateLimitConfigItems(ukCarbonIntensitySourceName, 1, 5)...)
+}
+
+// ukCarbonIntensityReading is the schema published by the UK Carbon Intensity data source. It has every field of
+// the CO2 Signal schema, where carbon_intensity is the actual intensity if it is known and the forecast otherwise,
+// followed by the details of the half-hour period. Only GB-REG-18 has an actual intensity; it is null for the
+// other regions. The forecast holds the following 48 hours, so it does not affect the checkpoint of the zone.
+type ukCarbonIntensityReading struct {
+	co2SignalProviderResponse
+	RegionID          int                         `json:"region_id"`
+	DNORegion         string                      `json:"dno_region"` // The distribution network operator's region.
+	PeriodFrom        string                      `json:"period_from"`
+	PeriodTo          string                      `json:"period_to"`
+	IntensityActual   *float64                    `json:"intensity_actual"`
+	IntensityForecast float64                     `json:"intensity_forecast"`
+	IntensityIndex    string                      `json:"intensity_index"` // very low, low, moderate, high or very high.
+	GenerationMix     map[string]float64          `json:"generation_mix"`  // Percentage of generation by fuel.
+	Forecast          []ukCarbonIntensityForecast `json:"forecast,omitempty"`
+}
+
+// ukCarbonIntensityForecast is the forecast for a half-hour period.
+type ukCarbonIntensityForecast struct {
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	Forecast       float64 `json:"forecast"`
+	IntensityIndex string  `json:"intensity_index"`
+}
+
+// ukRegion is a region in the API's responses.
+type ukRegion struct {
+	RegionID  int        `json:"regionid"`
+	DNORegion string     `json:"dnoregion"`
+	ShortName string     `json:"shortname"`
+	Data      []ukPeriod `json:"data"`
+}
+
+// ukPeriod is the intensity and generation mix of a half-hour period in the API's responses.
+type ukPeriod struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Intensity struct {
+		Forecast *float64 `json:"forecast"`
+		Actual   *float64 `json:"actual"`
+		Index    string   `json:"index"`
+	} `json:"intensity"`
+	GenerationMix []struct {
+		Fuel string  `json:"fuel"`
+		Perc float64 `json:"perc"`
+	} `json:"generationmix"`
+}
+
+// UKCarbonIntensityDataProvider is an implementation of the IDataSource that uses the National Grid ESO Carbon
+// Intensity API (carbonintensity.org.uk). The API is free and needs no key. It covers the 14 distribution network
+// regions of Great Britain, England, Scotland, Wales and the whole of Great Britain, which are zones GB-REG-1 to
+// GB-REG-18. Each reading is the current half-hour period with its generation mix and, optionally, the forecast
+// for the next 48 hours. config/uk-carbon-intensity-trino-schema.json describes the readings.
+type UKCarbonIntensityDataProvider struct {
+	client   *httpClient
+	registry *zones.Registry
+	baseURL  string
+	forecast bool
+}
+
+// Initialise reads the settings from the configuration file.
+func (r *UKCarbonIntensityDataProvider) Initialise() {
+	appConfig := config.App()
+	r.baseURL = strings.TrimSuffix(appConfig.String(ukCarbonIntensityURLConfigItem), "/")
+	r.forecast = appConfig.Bool(ukCarbonIntensityForecastConfigItem)
+
+	r.client = newHTTPClient(newRateLimiter(ukCarbonIntensitySourceName))
+
+	log.Printf("UKCarbonIntensityDataProvider::Initialise(): url=%s forecast=%v", r.baseURL, r.forecast)
+}
+
+// SetZoneRegistry assigns the registry that provides the country and zone names added to each reading.
+func (r *UKCarbonIntensityDataProvider) SetZoneRegistry(registry *zones.Registry) {
+	r.registry = registry
+}
+
+// GetAvailableZones returns a zone for each region the API has data for, and adds the region names to the registry.
+// https://api.carbonintensity.org.uk/regional
+func (r *UKCarbonIntensityDataProvider) GetAvailableZones(ctx context.Context) ([]string, error) {
+	var periods []struct {
+		Regions []ukRegion `json:"regions"`
+	}
+	if err := r.getData(ctx, "", r.baseURL+"/regional", &periods); err != nil {
+		return nil, err
+	}
+	if len(periods) == 0 {
+		return nil, newSourceError(ErrMalformedPayload, "", 0, fmt.Errorf("no regions"))
+	}
+
+	var zoneList []string
+	for _, region := range periods[0].Regions {
+		zone := ukRegionZonePrefix + strconv.Itoa(region.RegionID)
+		zoneList = append(zoneList, zone)
+		if r.registry != nil {
+			r.registry.AddMissing(zone, zones.ZoneDetails{CountryName: "Great Britain", ZoneName: region.ShortName})
+		}
+	}
+	log.Printf("UKCarbonIntensityDataProvider::GetAvailableZones(): %d zones", len(zoneList))
+
+	return zoneList, nil
+}
+
+// GetCarbonIntensity retrieves the intensity of the current half-hour period, and the forecast if it is enabled,
+// for the region. The national actual intensity is added for GB-REG-18.
+func (r *UKCarbonIntensityDataProvider) GetCarbonIntensity(ctx context.Context, zone string) ([]DataSourceDetails, error) {
+	log.Printf("UKCarbonIntensityDataProvider::GetCarbonIntensity(%s)", zone)
+
+	regionID, err := ukRegionID(zone)
+	if err != nil {
+		return nil, newSourceError(ErrZoneUnsupported, zone, 0, err)
+	}
+
+	// The forecast starts with the current period, so one request returns both.
+	// https://api.carbonintensity.org.uk/regional/intensity/2022-06-01T12:00Z/fw48h/regionid/13
+	from := time.Now().UTC().Format(ukCarbonIntensityDatetimeFormat)
+	request := fmt.Sprintf("%s/regional/intensity/%s/fw48h/regionid/%d", r.baseURL, from, regionID)
+
+	var region ukRegion
+	if err := r.getData(ctx, zone, request, &region); err != nil {
+		return nil, err
+	}
+
+	var national *ukPeriod
+	if regionID == ukNationalRegionID {
+		if national, err = r.getNational(ctx, zone); err != nil {
+			return nil, err
+		}
+	}
+
+	reading, err := convertUKCarbonIntensity(zone, region, national, r.forecast)
+	if err != nil {
+		return nil, err
+	}
+	describeZone(r.registry, &reading.co2SignalProviderResponse)
+
+	msg, err := json.Marshal(reading)
+	if err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	log.Printf("Parsed Response: %s : %s\n", reading.Key, msg)
+
+	return []DataSourceDetails{{Key: reading.Key, Datetime: reading.Datetime, Source: ukCarbonIntensitySourceName, ProviderResp: string(msg)}}, nil
+}
+
+// getNational returns the intensity of Great Britain for the current period, including the actual intensity if it
+// is known yet. Returns nil if there is no current period. https://api.carbonintensity.org.uk/intensity
+func (r *UKCarbonIntensityDataProvider) getNational(ctx context.Context, zone string) (*ukPeriod, error) {
+	var periods []ukPeriod
+	if err := r.getData(ctx, zone, r.baseURL+"/intensity", &periods); err != nil {
+		return nil, err
+	}
+	if len(periods) == 0 {
+		return nil, nil
+	}
+
+	return &periods[0], nil
+}
+
+// getData sends the request and decodes the data field of the response. Depending on the endpoint the data is
+// an object or an array. If the response is an array with one element and resp is not a slice, the element is
+// decoded into resp. A null data field, or an empty array when resp is not a slice, is an ErrZoneUnsupported
+// error.
+func (r *UKCarbonIntensityDataProvider) getData(ctx context.Context, zone string, request string, resp interface{}) error {
+	responseData, err := r.client.get(ctx, zone, request, map[string]string{"Accept": "application/json"})
+	if err != nil {
+		return err
+	}
+
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(responseData, &envelope); err != nil {
+		return newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	data := bytes.TrimSpace(envelope.Data)
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no data"))
+	}
+
+	err = json.Unmarshal(data, resp)
+	if _, wrongType := err.(*json.UnmarshalTypeError); wrongType && data[0] == '[' {
+		var list []json.RawMessage
+		if err = json.Unmarshal(data, &list); err == nil {
+			if len(list) == 0 {
+				return newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no data"))
+			}
+			if len(list) != 1 {
+				return newSourceError(ErrMalformedPayload, zone, 0, fmt.Errorf("expected one region, got %d", len(list)))
+			}
+			err = json.Unmarshal(list[0], resp)
+		}
+	}
+	if err != nil {
+		return newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	return nil
+}
+
+// ukRegionID returns the region ID of a zone key such as GB-REG-13.
+func ukRegionID(zone string) (int, error) {
+	if !strings.HasPrefix(zone, ukRegionZonePrefix) {
+		return 0, fmt.Errorf("zone keys have the form %s<region id>", ukRegionZonePrefix)
+	}
+
+	return strconv.Atoi(strings.TrimPrefix(zone, ukRegionZonePrefix))
+}
+
+// convertUKCarbonIntensity converts a region's periods to the published schema. The first period is the current
+// one. national is the intensity of Great Britain, or nil. Its actual intensity is used if it is for the current
+// period. Returns an ErrMalformedPayload error if the current period
+// is incomplete.
+func convertUKCarbonIntensity(zone string, region ukRegion, national *ukPeriod, withForecast bool) (ukCarbonIntensityReading, error) {
+	var reading ukCarbonIntensityReading
+
+	if len(region.Data) == 0 {
+		return reading, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no periods"))
+	}
+	current := region.Data[0]
+	if current.Intensity.Forecast == nil {
+		return reading, newSourceError(ErrMalformedPayload, zone, 0, fmt.Errorf("no forecast intensity for %s", current.From))
+	}
+
+	datetime, err := ukDatetime(current.From)
+	if err != nil {
+		return reading, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	reading.Key = zone
+	reading.CountryCode = zone
+	reading.Status = "ok"
+	reading.Datetime = datetime
+	reading.UnitName = "carbonIntensity"
+	reading.UnitValue = "gCO2eq/kWh"
+	reading.RegionID = region.RegionID
+	reading.DNORegion = region.DNORegion
+	reading.PeriodFrom = datetime
+	reading.PeriodTo, _ = ukDatetime(current.To)
+	if national != nil && national.From == current.From {
+		reading.IntensityActual = national.Intensity.Actual
+	}
+	reading.IntensityForecast = *current.Intensity.Forecast
+	reading.IntensityIndex = current.Intensity.Index
+
+	reading.CarbonIntensity = reading.IntensityForecast
+	if reading.IntensityActual != nil {
+		reading.CarbonIntensity = *reading.IntensityActual
+	}
+
+	reading.GenerationMix = make(map[string]float64, len(current.GenerationMix))
+	for _, mix := range current.GenerationMix {
+		reading.GenerationMix[mix.Fuel] = mix.Perc
+	}
+	for _, fuel := range ukFossilFuels {
+		reading.FosselFuelPercentage += reading.GenerationMix[fuel]
+	}
+
+	if !withForecast {
+		return reading, nil
+	}
+
+	for _, period := range region.Data[1:] {
+		if period.Intensity.Forecast == nil {
+			continue
+		}
+
+		var forecast ukCarbonIntensityForecast
+		forecast.From, _ = ukDatetime(period.From)
+		forecast.To, _ = ukDatetime(period.To)
+		forecast.Forecast = *period.Intensity.Forecast
+		forecast.IntensityIndex = period.Intensity.Index
+		reading.Forecast = append(reading.Forecast, forecast)
+	}
+
+	return reading, nil
+}
+
+// ukDatetime converts a datetime from the API's format to the format CO2 Signal uses, so readings from every
+// data source can be compared.
+func ukDatetime(value string) (string, error) {
+	t, err := time.Parse(ukCarbonIntensityDatetimeFormat, value)
+	if err != nil {
+		return "", err
+	}
+
+	return t.UTC().Format(co2SignalDatetimeFormat), nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixtureServer serves the recorded responses in testdata. route returns the fixture for a request path, or ""
+// for a 404 response.
+func fixtureServer(t *testing.T, route func(path string) string) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fixture := route(req.URL.Path)
+		if fixture == "" {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeFile(w, req, filepath.Join("testdata", fixture))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// newTestHTTPClient returns a client with no rate limit or retries.
+func newTestHTTPClient() *httpClient {
+	return &httpClient{limiter: &rateLimiter{}, timeout: 5 * time.Second}
+}
+
+// ukRoutes routes the UK Carbon Intensity API's paths to fixtures. The regional intensity path contains the
+// current time, so it is matched on the region ID.
+func ukRoutes(regional, regionalIntensity, national string) func(path string) string {
+	return func(path string) string {
+		switch {
+		case path == "/regional":
+			return regional
+		case strings.HasPrefix(path, "/regional/intensity/"):
+			return regionalIntensity
+		case path == "/intensity":
+			return national
+		}
+		return ""
+	}
+}
+
+func floatPtr(value float64) *float64 {
+	return &value
+}
+
+func TestUKCarbonIntensityGetAvailableZones(t *testing.T) {
+	srv := fixtureServer(t, ukRoutes("uk-regional.json", "", ""))
+	provider := &UKCarbonIntensityDataProvider{client: newTestHTTPClient(), baseURL: srv.URL}
+
+	zoneList, err := provider.GetAvailableZones(context.Background())
+	if err != nil {
+		t.Fatalf("GetAvailableZones() error = %v", err)
+	}
+
+	want := []string{"GB-REG-1", "GB-REG-13", "GB-REG-18"}
+	if !reflect.DeepEqual(zoneList, want) {
+		t.Errorf("GetAvailableZones() = %v, want %v", zoneList, want)
+	}
+}
+
+func TestUKCarbonIntensityGetAvailableZonesNoData(t *testing.T) {
+	srv := fixtureServer(t, ukRoutes("uk-null-data.json", "", ""))
+	provider := &UKCarbonIntensityDataProvider{client: newTestHTTPClient(), baseURL: srv.URL}
+
+	if _, err := provider.GetAvailableZones(context.Background()); !errors.Is(err, ErrZoneUnsupported) {
+		t.Errorf("GetAvailableZones() error = %v, want %v", err, ErrZoneUnsupported)
+	}
+}
+
+func TestUKCarbonIntensityGetCarbonIntensity(t *testing.T) {
+	londonForecast := []ukCarbonIntensityForecast{
+		{From: "2022-10-17T12:00:00.000Z", To: "2022-10-17T12:30:00.000Z", Forecast: 176, IntensityIndex: "moderate"},
+		{From: "2022-10-17T13:00:00.000Z", To: "2022-10-17T13:30:00.000Z", Forecast: 98, IntensityIndex: "low"},
+	}
+
+	tests := []struct {
+		name              string
+		zone              string
+		regionalIntensity string
+		national          string
+		forecast          bool
+		wantIntensity     float64
+		wantActual        *float64
+		wantForecast      float64
+		wantIndex         string
+		wantFossil        float64
+		wantForecastList  []ukCarbonIntensityForecast
+	}{
+		{
+			// Only GB-REG-18 has an actual, so the carbon intensity of other regions is the forecast. The period
+			// with a null forecast is left out of the forecast list.
+			name: "region uses the forecast", zone: "GB-REG-13", regionalIntensity: "uk-regional-intensity-london.json",
+			forecast: true, wantIntensity: 182, wantForecast: 182, wantIndex: "moderate", wantFossil: 39.4,
+			wantForecastList: londonForecast,
+		},
+		{
+			name: "forecast list disabled", zone: "GB-REG-13", regionalIntensity: "uk-regional-intensity-london.json",
+			wantIntensity: 182, wantForecast: 182, wantIndex: "moderate", wantFossil: 39.4,
+		},
+		{
+			name: "national actual", zone: "GB-REG-18", regionalIntensity: "uk-regional-intensity-gb.json",
+			national: "uk-intensity.json", wantIntensity: 171, wantActual: floatPtr(171), wantForecast: 164,
+			wantIndex: "moderate", wantFossil: 37.5,
+		},
+		{
+			name: "national actual not known yet", zone: "GB-REG-18", regionalIntensity: "uk-regional-intensity-gb.json",
+			national: "uk-intensity-no-actual.json", wantIntensity: 164, wantForecast: 164, wantIndex: "moderate",
+			wantFossil: 37.5,
+		},
+		{
+			// The national endpoint can lag behind the regional one. An actual for another period is not used.
+			name: "national actual for the previous period", zone: "GB-REG-18",
+			regionalIntensity: "uk-regional-intensity-gb.json", national: "uk-intensity-previous-period.json",
+			wantIntensity: 164, wantForecast: 164, wantIndex: "moderate", wantFossil: 37.5,
+		},
+		{
+			name: "national has no periods", zone: "GB-REG-18", regionalIntensity: "uk-regional-intensity-gb.json",
+			national: "uk-empty-data.json", wantIntensity: 164, wantForecast: 164, wantIndex: "moderate",
+			wantFossil: 37.5,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fixtureServer(t, ukRoutes("", tt.regionalIntensity, tt.national))
+			provider := &UKCarbonIntensityDataProvider{client: newTestHTTPClient(), baseURL: srv.URL, forecast: tt.forecast}
+
+			details, err := provider.GetCarbonIntensity(context.Background(), tt.zone)
+			if err != nil {
+				t.Fatalf("GetCarbonIntensity() error = %v", err)
+			}
+			if len(details) != 1 {
+				t.Fatalf("GetCarbonIntensity() returned %d readings, want 1", len(details))
+			}
+			if details[0].Key != tt.zone || details[0].Datetime != "2022-10-17T11:30:00.000Z" {
+				t.Errorf("GetCarbonIntensity() key = %s, datetime = %s", details[0].Key, details[0].Datetime)
+			}
+
+			var reading ukCarbonIntensityReading
+			if err := json.Unmarshal([]byte(details[0].ProviderResp), &reading); err != nil {
+				t.Fatalf("failed to decode the reading: %v", err)
+			}
+
+			if reading.CarbonIntensity != tt.wantIntensity {
+				t.Errorf("carbon_intensity = %g, want %g", reading.CarbonIntensity, tt.wantIntensity)
+			}
+			if !reflect.DeepEqual(reading.IntensityActual, tt.wantActual) {
+				t.Errorf("intensity_actual = %v, want %v", reading.IntensityActual, tt.wantActual)
+			}
+			if reading.IntensityForecast != tt.wantForecast {
+				t.Errorf("intensity_forecast = %g, want %g", reading.IntensityForecast, tt.wantForecast)
+			}
+			if reading.IntensityIndex != tt.wantIndex {
+				t.Errorf("intensity_index = %q, want %q", reading.IntensityIndex, tt.wantIndex)
+			}
+			if math.Abs(reading.FosselFuelPercentage-tt.wantFossil) > 1e-9 {
+				t.Errorf("fossel_fuel_percentage = %g, want %g", reading.FosselFuelPercentage, tt.wantFossil)
+			}
+			if reading.PeriodFrom != "2022-10-17T11:30:00.000Z" || reading.PeriodTo != "2022-10-17T12:00:00.000Z" {
+				t.Errorf("period = %s to %s", reading.PeriodFrom, reading.PeriodTo)
+			}
+			if !reflect.DeepEqual(reading.Forecast, tt.wantForecastList) {
+				t.Errorf("forecast = %+v, want %+v", reading.Forecast, tt.wantForecastList)
+			}
+		})
+	}
+}
+
+func TestUKCarbonIntensityGetCarbonIntensityErrors(t *testing.T) {
+	tests := []struct {
+		name              string
+		zone              string
+		regionalIntensity string
+		want              error
+	}{
+		{name: "null data", zone: "GB-REG-13", regionalIntensity: "uk-null-data.json", want: ErrZoneUnsupported},
+		{name: "empty data", zone: "GB-REG-13", regionalIntensity: "uk-empty-data.json", want: ErrZoneUnsupported},
+		{name: "no periods", zone: "GB-REG-13", regionalIntensity: "uk-regional-intensity-no-periods.json", want: ErrZoneUnsupported},
+		{name: "no forecast", zone: "GB-REG-13", regionalIntensity: "uk-regional-intensity-no-forecast.json", want: ErrMalformedPayload},
+		{name: "not a region", zone: "GB", regionalIntensity: "uk-regional-intensity-london.json", want: ErrZoneUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fixtureServer(t, ukRoutes("", tt.regionalIntensity, ""))
+			provider := &UKCarbonIntensityDataProvider{client: newTestHTTPClient(), baseURL: srv.URL, forecast: true}
+
+			if _, err := provider.GetCarbonIntensity(context.Background(), tt.zone); !errors.Is(err, tt.want) {
+				t.Errorf("GetCarbonIntensity() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data_source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+	"os-climate.org/carbon-intensity/pkg/zones"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Configuration items for the WattTime data source.
+const (
+	wattTimeURLConfigItem       = "watttime-url"       // Base URL of the API.
+	wattTimeLocationsConfigItem = "watttime-locations" // Zones defined by a location, as zone:latitude:longitude.
+)
+
+// Defaults used if the configuration file does not set the WattTime items.
+const (
+	defaultWattTimeURL = "https://api.watttime.org"
+)
+
+const wattTimeSourceName string = "watttime"
+
+// Environment variables that hold the WattTime account's credentials.
+const (
+	wattTimeUsernameEnvVar = "WATTTIME_USERNAME"
+	wattTimePasswordEnvVar = "WATTTIME_PASSWORD"
+)
+
+// The signal that is read: the marginal operating emissions rate of CO2.
+const wattTimeSignalType = "co2_moer"
+
+// Readings are tagged with this signal type so they can be told apart from the average intensity of other sources.
+const marginalSignalType = "marginal"
+
+// Tokens are valid for 30 minutes. A new one is requested a little before the old one expires.
+const wattTimeTokenLifetime = 25 * time.Minute
+
+// The period before now that is requested from the historical endpoint. It covers several data points, so the
+// latest is found even if it is a little late.
+const wattTimeMOERWindow = 30 * time.Minute
+
+// Grams per pound, to convert the MOER from lbs_co2_per_mwh to gCO2eq/kWh.
+const gramsPerPound = 453.59237
+
+// wattTimeConfigItems returns the configuration items used by WattTime. It allows 3000 requests in 5 minutes.
+func wattTimeConfigItems() []config.Item {
+	items := []config.Item{
+		{Key: wattTimeURLConfigItem, Kind: config.KindString, Default: defaultWattTimeURL},
+		{Key: wattTimeLocationsConfigItem, Kind: config.KindList, Check: func(value string) error {
+			_, err := parseWattTimeLocations(config.SplitList(value))
+			return err
+		}},
+	}
+
+	return append(items, rateLimitConfigItems(wattTimeSourceName, 5, 10)...)
+}
+
+// wattTimeReading is the schema published by the WattTime data source. It has every field of the CO2 Signal
+// schema, where carbon_intensity is the MOER converted to gCO2eq/kWh and fossel_fuel_percentage is always null
+// because WattTime does not report the generation mix (0 would read as no fossil fuel), followed by the WattTime
+// signal.
+type wattTimeReading struct {
+	co2SignalProviderResponse
+	FosselFuelPercentage *float64 `json:"fossel_fuel_percentage"` // Replaces the field of the CO2 Signal schema.
+	SignalType           string   `json:"signal_type"`            // Always marginal.
+	Region               string   `json:"watttime_region"`
+	RegionFullName       string   `json:"watttime_region_full_name,omitempty"`
+	MOER                 float64  `json:"moer"`         // The MOER as WattTime reports it.
+	MOERUnits            string   `json:"moer_units"`   // Usually lbs_co2_per_mwh.
+	SignalIndex          *float64 `json:"signal_index"` // Percentile of the MOER over the last month, from 0 (cleanest) to 100.
+}
+
+// wattTimeSignal is the response of the historical and signal-index endpoints.
+type wattTimeSignal struct {
+	Data []struct {
+		PointTime string  `json:"point_time"`
+		Value     float64 `json:"value"`
+	} `json:"data"`
+	Meta struct {
+		Region     string `json:"region"`
+		SignalType string `json:"signal_type"`
+		Units      string `json:"units"`
+	} `json:"meta"`
+}
+
+// wattTimeLocation is a zone that is defined by a location instead of a WattTime region.
+type wattTimeLocation struct {
+	latitude  string
+	longitude string
+}
+
+// wattTimeRegion is the WattTime region a zone is in.
+type wattTimeRegion struct {
+	Region         string `json:"region"`
+	RegionFullName string `json:"region_full_name"`
+}
+
+// WattTimeDataProvider is an implementation of the IDataSource that reads marginal operating emissions rates
+// (MOER) from the WattTime v3 API, for carbon-aware scheduling. A zone is either a WattTime region, e.g.
+// CAISO_NORTH, or a zone listed in watttime-locations, which is looked up by its location. Each reading has the
+// latest MOER and its signal index, and is tagged signal_type=marginal. The API token is requested when it is
+// first needed and requested again when it expires or is rejected.
+type WattTimeDataProvider struct {
+	client    *httpClient
+	registry  *zones.Registry
+	baseURL   string
+	username  string
+	password  string
+	locations map[string]wattTimeLocation
+
+	logins      singleflight.Group // Shares one login between the requests that need a token at the same time.
+	mutex       sync.Mutex
+	token       string
+	tokenExpiry time.Time
+	regions     map[string]wattTimeRegion // The regions of the zones that have been looked up.
+}
+
+// Initialise reads the credentials from the environment and the settings from the configuration file.
+func (r *WattTimeDataProvider) Initialise() {
+	r.username = os.Getenv(wattTimeUsernameEnvVar)
+	r.password = os.Getenv(wattTimePasswordEnvVar)
+	if r.username == "" || r.password == "" {
+		log.Fatalf("WattTimeDataProvider::Initialise(). Credential environment variables (%s and %s) not set.",
+			wattTimeUsernameEnvVar, wattTimePasswordEnvVar)
+	}
+
+	appConfig := config.App()
+	r.baseURL = strings.TrimSuffix(appConfig.String(wattTimeURLConfigItem), "/")
+
+	var err error
+	r.locations, err = parseWattTimeLocations(appConfig.List(wattTimeLocationsConfigItem))
+	if err != nil {
+		log.Fatalf("WattTimeDataProvider::Initialise(): %v", err)
+	}
+	r.regions = make(map[string]wattTimeRegion)
+
+	r.client = newHTTPClient(newRateLimiter(wattTimeSourceName))
+
+	log.Printf("WattTimeDataProvider::Initialise(): url=%s locations=%d", r.baseURL, len(r.locations))
+}
+
+// SetZoneRegistry assigns the registry that provides the country and zone names added to each reading.
+func (r *WattTimeDataProvider) SetZoneRegistry(registry *zones.Registry) {
+	r.registry = registry
+}
+
+// GetAvailableZones returns the regions the account can read the MOER of, and the zones in watttime-locations.
+// https://api.watttime.org/v3/my-access
+func (r *WattTimeDataProvider) GetAvailableZones(ctx context.Context) ([]string, error) {
+	var access struct {
+		SignalTypes []struct {
+			SignalType string `json:"signal_type"`
+			Regions    []struct {
+				Region         string `json:"region"`
+				RegionFullName string `json:"region_full_name"`
+			} `json:"regions"`
+		} `json:"signal_types"`
+	}
+	if err := r.getJSON(ctx, "", r.baseURL+"/v3/my-access", &access); err != nil {
+		return nil, err
+	}
+
+	var zoneList []string
+	r.mutex.Lock()
+	for _, signal := range access.SignalTypes {
+		if signal.SignalType != wattTimeSignalType {
+			continue
+		}
+		for _, region := range signal.Regions {
+			zoneList = append(zoneList, region.Region)
+			r.regions[region.Region] = wattTimeRegion{Region: region.Region, RegionFullName: region.RegionFullName}
+			if r.registry != nil {
+				r.registry.AddMissing(region.Region, zones.ZoneDetails{ZoneName: region.RegionFullName})
+			}
+		}
+	}
+	r.mutex.Unlock()
+	for zone := range r.locations {
+		zoneList = append(zoneList, zone)
+	}
+	sort.Strings(zoneList)
+
+	log.Printf("WattTimeDataProvider::GetAvailableZones(): %d zones", len(zoneList))
+
+	return zoneList, nil
+}
+
+// GetCarbonIntensity retrieves the latest MOER and signal index of the zone's region.
+func (r *WattTimeDataProvider) GetCarbonIntensity(ctx context.Context, zone string) ([]DataSourceDetails, error) {
+	log.Printf("WattTimeDataProvider::GetCarbonIntensity(%s)", zone)
+
+	region, err := r.lookupRegion(ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	// https://api.watttime.org/v3/historical?region=CAISO_NORTH&signal_type=co2_moer&start=...&end=...
+	now := time.Now().UTC()
+	query := url.Values{}
+	query.Set("region", region.Region)
+	query.Set("signal_type", wattTimeSignalType)
+	query.Set("start", now.Add(-wattTimeMOERWindow).Format(time.RFC3339))
+	query.Set("end", now.Format(time.RFC3339))
+	var moer wattTimeSignal
+	if err := r.getJSON(ctx, zone, r.baseURL+"/v3/historical?"+query.Encode(), &moer); err != nil {
+		return nil, err
+	}
+
+	// https://api.watttime.org/v3/signal-index?region=CAISO_NORTH&signal_type=co2_moer
+	query = url.Values{}
+	query.Set("region", region.Region)
+	query.Set("signal_type", wattTimeSignalType)
+	var index wattTimeSignal
+	if err := r.getJSON(ctx, zone, r.baseURL+"/v3/signal-index?"+query.Encode(), &index); err != nil {
+		return nil, err
+	}
+
+	reading, err := convertWattTime(zone, region, moer, index)
+	if err != nil {
+		return nil, err
+	}
+	describeZone(r.registry, &reading.co2SignalProviderResponse)
+
+	msg, err := json.Marshal(reading)
+	if err != nil {
+		return nil, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	log.Printf("Parsed Response: %s : %s\n", reading.Key, msg)
+
+	return []DataSourceDetails{{Key: reading.Key, Datetime: reading.Datetime, Source: wattTimeSourceName, ProviderResp: string(msg)}}, nil
+}
+
+// lookupRegion returns the WattTime region of a zone. A zone in watttime-locations is looked up by its location
+// the first time it is read, and its name is added to the registry. Any other zone is a WattTime region.
+// https://api.watttime.org/v3/region-from-loc?latitude=42.372&longitude=-72.519&signal_type=co2_moer
+func (r *WattTimeDataProvider) lookupRegion(ctx context.Context, zone string) (wattTimeRegion, error) {
+	r.mutex.Lock()
+	region, ok := r.regions[zone]
+	r.mutex.Unlock()
+	if ok {
+		return region, nil
+	}
+
+	location, ok := r.locations[zone]
+	if !ok {
+		return wattTimeRegion{Region: zone}, nil
+	}
+
+	query := url.Values{}
+	query.Set("latitude", location.latitude)
+	query.Set("longitude", location.longitude)
+	query.Set("signal_type", wattTimeSignalType)
+	if err := r.getJSON(ctx, zone, r.baseURL+"/v3/region-from-loc?"+query.Encode(), &region); err != nil {
+		return region, err
+	}
+	if region.Region == "" {
+		return region, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no region at %s,%s", location.latitude, location.longitude))
+	}
+	log.Printf("WattTimeDataProvider: %s is in region %s (%s)", zone, region.Region, region.RegionFullName)
+	if r.registry != nil {
+		r.registry.AddMissing(zone, zones.ZoneDetails{ZoneName: region.RegionFullName})
+	}
+
+	r.mutex.Lock()
+	r.regions[zone] = region
+	r.mutex.Unlock()
+
+	return region, nil
+}
+
+// getJSON sends an authenticated request and decodes the response. If the token is rejected a new one is
+// requested and the request is sent again.
+func (r *WattTimeDataProvider) getJSON(ctx context.Context, zone string, request string, resp interface{}) error {
+	var responseData []byte
+	for attempt := 0; ; attempt++ {
+		token, err := r.getToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		responseData, err = r.client.get(ctx, zone, request, map[string]string{"Authorization": "Bearer " + token})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrUnauthorized) || attempt > 0 {
+			return err
+		}
+
+		log.Printf("WARNING: WattTime rejected the token, logging in again: %v", err)
+		r.resetToken(token)
+	}
+
+	if err := json.Unmarshal(responseData, resp); err != nil {
+		return newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	return nil
+}
+
+// getToken returns the API token, logging in if there is no token or it is about to expire. The mutex is not
+// held during the login, so zone lookups are not blocked by it, and concurrent callers share a single login.
+// https://api.watttime.org/login
+func (r *WattTimeDataProvider) getToken(ctx context.Context) (string, error) {
+	r.mutex.Lock()
+	if r.token != "" && time.Now().Before(r.tokenExpiry) {
+		token := r.token
+		r.mutex.Unlock()
+		return token, nil
+	}
+	r.mutex.Unlock()
+
+	token, err, _ := r.logins.Do("login", func() (interface{}, error) {
+		return r.login(ctx)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token.(string), nil
+}
+
+// login requests a new API token and stores it.
+func (r *WattTimeDataProvider) login(ctx context.Context) (string, error) {
+	credentials := base64.StdEncoding.EncodeToString([]byte(r.username + ":" + r.password))
+	responseData, err := r.client.get(ctx, "", r.baseURL+"/login", map[string]string{"Authorization": "Basic " + credentials})
+	if err != nil {
+		return "", err
+	}
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(responseData, &login); err != nil {
+		return "", newSourceError(ErrMalformedPayload, "", 0, err)
+	}
+	if login.Token == "" {
+		return "", newSourceError(ErrUnauthorized, "", 0, fmt.Errorf("no token in the login response"))
+	}
+
+	r.mutex.Lock()
+	r.token = login.Token
+	r.tokenExpiry = time.Now().Add(wattTimeTokenLifetime)
+	r.mutex.Unlock()
+	log.Printf("WattTimeDataProvider: Logged in as %s", r.username)
+
+	return login.Token, nil
+}
+
+// resetToken discards the token so the next request logs in again, unless another request already has.
+func (r *WattTimeDataProvider) resetToken(token string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.token == token {
+		r.token = ""
+	}
+}
+
+// convertWattTime converts the MOER and signal index of a zone to the published schema. Returns an
+// ErrZoneUnsupported error if there is no MOER for the zone.
+func convertWattTime(zone string, region wattTimeRegion, moer wattTimeSignal, index wattTimeSignal) (wattTimeReading, error) {
+	var reading wattTimeReading
+
+	// The latest data point is the last one.
+	if len(moer.Data) == 0 {
+		return reading, newSourceError(ErrZoneUnsupported, zone, 0, fmt.Errorf("no MOER for region %s", region.Region))
+	}
+	latest := moer.Data[len(moer.Data)-1]
+
+	pointTime, err := time.Parse(time.RFC3339, latest.PointTime)
+	if err != nil {
+		return reading, newSourceError(ErrMalformedPayload, zone, 0, err)
+	}
+
+	reading.Key = zone
+	reading.CountryCode = zone
+	reading.Status = "ok"
+	reading.Datetime = pointTime.UTC().Format(co2SignalDatetimeFormat)
+	reading.UnitName = "carbonIntensity"
+	reading.UnitValue = "gCO2eq/kWh"
+	reading.SignalType = marginalSignalType
+	reading.Region = region.Region
+	reading.RegionFullName = region.RegionFullName
+	reading.MOER = latest.Value
+	reading.MOERUnits = moer.Meta.Units
+
+	switch moer.Meta.Units {
+	case "lbs_co2_per_mwh", "":
+		reading.CarbonIntensity = latest.Value * gramsPerPound / 1000
+	case "g_co2_per_kwh":
+		reading.CarbonIntensity = latest.Value
+	default:
+		return reading, newSourceError(ErrMalformedPayload, zone, 0, fmt.Errorf("unknown MOER units %s", moer.Meta.Units))
+	}
+
+	if len(index.Data) > 0 {
+		reading.SignalIndex = &index.Data[len(index.Data)-1].Value
+	}
+
+	return reading, nil
+}
+
+// parseWattTimeLocations parses a list of zone:latitude:longitude, e.g. US-CAL-CISO:38.58:-121.49.
+func parseWattTimeLocations(list []string) (map[string]wattTimeLocation, error) {
+	locations := make(map[string]wattTimeLocation)
+	for _, entry := range list {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%s is not zone:latitude:longitude", entry)
+		}
+
+		lat, err1 := strconv.ParseFloat(parts[1], 64)
+		lon, err2 := strconv.ParseFloat(parts[2], 64)
+		if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return nil, fmt.Errorf("%s does not have a valid latitude and longitude", entry)
+		}
+
+		locations[parts[0]] = wattTimeLocation{latitude: parts[1], longitude: parts[2]}
+	}
+
+	return locations, nil
+}
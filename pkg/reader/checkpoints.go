@@ -0,0 +1,58 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"log"
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/checkpoint"
+)
+
+// recordFetch records the time a zone was last fetched successfully. A nil store disables checkpointing.
+func recordFetch(store checkpoint.ICheckpointStore, zone string, fetchTime time.Time) {
+	if store == nil {
+		return
+	}
+
+	if err := store.RecordFetch(zone, fetchTime); err != nil {
+		log.Printf("WARNING: Failed to record fetch checkpoint for %s: %v", zone, err)
+	}
+}
+
+// lastFetch returns the time a zone was last fetched successfully, and false if it is not known.
+func lastFetch(store checkpoint.ICheckpointStore, zone string) (time.Time, bool) {
+	if store == nil {
+		return time.Time{}, false
+	}
+
+	cp, ok := store.Get(zone)
+	if !ok || cp.FetchTime.IsZero() {
+		return time.Time{}, false
+	}
+
+	return cp.FetchTime, true
+}
+
+// isNewReading returns false if the reading has already been published, i.e. the zone's data has not advanced
+// since the last checkpoint.
+func isNewReading(store checkpoint.ICheckpointStore, reading Reading) bool {
+	if store == nil || store.HasAdvanced(reading.Key, reading.Datetime) {
+		return true
+	}
+
+	log.Printf("Skipping %s: data has not advanced since %s", reading.Key, reading.Datetime)
+	return false
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"os-climate.org/carbon-intensity/pkg/data_source"
+)
+
+// errQuit is returned when a quit signal is received or the context is cancelled. It is not an error
+// condition for the reader.
+var errQuit = errors.New("quit signal received")
+
+// fetchZone requests the readings for a zone from the data source and decides what to do if that fails.
+// Transient errors have already been retried by the data source, so if the zone still fails the error is
+// logged and fetched is false so the reader moves on to the next zone. Errors that affect every zone (e.g.
+// unauthorized, or the daily quota is exhausted) are returned so the reader can stop. errQuit is returned if
+// the context has been cancelled.
+func fetchZone(ctx context.Context, provider data_source.IDataSource, zone string) (resp []data_source.DataSourceDetails, fetched bool, err error) {
+	resp, err = provider.GetCarbonIntensity(ctx, zone)
+	if err == nil {
+		return resp, true, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, false, errQuit
+	}
+
+	if data_source.IsFatal(err) || data_source.IsQuotaExhausted(err) {
+		log.Printf("ERROR: Stopping. Zone %s failed: %v", zone, err)
+		return nil, false, err
+	}
+
+	log.Printf("WARNING: Skipping zone %s: %v", zone, err)
+	return nil, false, nil
+}
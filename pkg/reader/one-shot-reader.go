@@ -1,10 +1,11 @@
 package reader
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"time"
 
+	"os-climate.org/carbon-intensity/pkg/checkpoint"
 	"os-climate.org/carbon-intensity/pkg/data_source"
 )
 
@@ -13,7 +14,9 @@ import (
 // as a configurable item.
 type OneShotReader struct {
 	dataProvider data_source.IDataSource
-	commsChannel chan string
+	checkpoints  checkpoint.ICheckpointStore
+	commsChannel chan Reading
+	doneChannel  chan error
 	quitChannel  chan int
 }
 
@@ -21,8 +24,9 @@ type OneShotReader struct {
 // Used to initialise the inter-process communication channels.
 // This may not be required if the esign calls for all GetFxPricing to be used as a go routine.
 // In which case the channel initialisers move into the base class.
-func (r *OneShotReader) Initialise(c chan string, quit chan int) {
+func (r *OneShotReader) Initialise(c chan Reading, done chan error, quit chan int) {
 	r.commsChannel = c
+	r.doneChannel = done
 	r.quitChannel = quit
 }
 
@@ -31,36 +35,58 @@ func (r *OneShotReader) SetDataProvider(ds data_source.IDataSource) {
 	r.dataProvider = ds
 }
 
+// SetCheckpointStore assigns the store used to skip readings that have already been published.
+func (r *OneShotReader) SetCheckpointStore(store checkpoint.ICheckpointStore) {
+	r.checkpoints = store
+}
+
 // GetCarbonIntensity initiates the retrieval of the market data from the provider. It defined the go channel for providing the results,
 // a separate channel for controlling shutdown, a list of currencies to retrieve the FX details for, the base Currency for the FX,
 // and a date stamp to filter the FX data on.
-func (r *OneShotReader) GetCarbonIntensity(countries []string) {
+func (r *OneShotReader) GetCarbonIntensity(ctx context.Context, countries []string) {
 	log.Println("OneShotReader::GetCarbonIntensity()")
 
-	r.GetCarbonIntensityFromProvider(countries)
+	err := r.GetCarbonIntensityFromProvider(ctx, countries)
+	if err == errQuit {
+		err = nil
+	}
 
-	r.commsChannel <- "done"
+	r.doneChannel <- err
 }
 
-func (r *OneShotReader) GetCarbonIntensityFromProvider(countries []string) {
+// GetCarbonIntensityFromProvider calls the IDataSource for each zone and sends the readings to the main thread.
+// A zone that fails is skipped. Returns an error if the data source cannot be used for any zone, or errQuit if
+// a quit signal was received part way through.
+func (r *OneShotReader) GetCarbonIntensityFromProvider(ctx context.Context, countries []string) error {
 	for _, country := range countries {
-		resp := r.dataProvider.GetCarbonIntensity(country)
+		resp, fetched, err := fetchZone(ctx, r.dataProvider, country)
+		if err != nil {
+			return err
+		}
+		if !fetched {
+			continue
+		}
+		fetchTime := time.Now().UTC()
+		recordFetch(r.checkpoints, country, fetchTime)
 
 		// Iterate over the list of returned readings and send each to the channel for processing in the main thread..
 		for _, v := range resp {
-			priceData := v.Key + "," + v.ProviderResp // Comma-separated header
+			reading := newReading(country, v, fetchTime)
+			if !isNewReading(r.checkpoints, reading) {
+				continue
+			}
 
 			select {
-			case r.commsChannel <- priceData: // Send the pricing info to the main loop via the pricing channel.
+			case r.commsChannel <- reading: // Send the reading to the main loop via the comms channel.
 				continue
-			case <-r.quitChannel: // Check if a quit signal has been received. If so, tell the main loop that all thread-termination steps are done..
-				fmt.Printf("Received QUIT signal.\n")
-				r.commsChannel <- "done"
-				return
+			case <-r.quitChannel: // Check if a quit signal has been received. If so, stop reading.
+				log.Printf("OneShotReader: Received a quit signal. Stopping.")
+				return errQuit
+			case <-ctx.Done():
+				return errQuit
 			}
 		}
-
-		// The service has a rate limit of one request per second.
-		time.Sleep(time.Second)
 	}
+
+	return nil
 }
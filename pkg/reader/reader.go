@@ -14,7 +14,12 @@
 
 package reader
 
-import "os-climate.org/carbon-intensity/pkg/data_source"
+import (
+	"context"
+
+	"os-climate.org/carbon-intensity/pkg/checkpoint"
+	"os-climate.org/carbon-intensity/pkg/data_source"
+)
 
 type CoOrds struct {
 }
@@ -28,13 +33,20 @@ type IReader interface {
 	// SetDataProvider assigns the DataProvider so this implementation can request the data to be retrieved.
 	SetDataProvider(data_source.IDataSource)
 
+	// SetCheckpointStore assigns the store used to skip readings that have already been published. The reader
+	// records when each zone is fetched. The caller records each reading that is published.
+	SetCheckpointStore(checkpoint.ICheckpointStore)
+
 	// Initialise configures all of the required runtime parameters and must be the first method called.
-	Initialise(c chan string, quit chan int)
+	// Readings are sent on c. When the reader stops it sends exactly one value on done: nil if it finished
+	// normally or was told to quit, or the error that stopped it. The reader stops when it receives on quit.
+	Initialise(c chan Reading, done chan error, quit chan int)
 
 	// GetCarbonIntensity initiates the retrieval of the carbon-intensity data for the supplied list of countries
 	// Data is published to the defined the go channel for processing in the main thread. There is a separate
-	// channel for controlling shutdown.
-	GetCarbonIntensity(countries []string)
+	// channel for signalling completion and another for controlling shutdown. Cancelling the context also
+	// stops the reader and abandons any request that is in progress.
+	GetCarbonIntensity(ctx context.Context, countries []string)
 
 	// GetCarbonIntensity initiates the retrieval of the carbon-intensity data for the supplied list of geo-corordinates
 	// Data is published to the defined the go channel for processing in the main thread. There is a separate
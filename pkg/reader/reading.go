@@ -0,0 +1,43 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package reader
+
+import (
+	"time"
+
+	"os-climate.org/carbon-intensity/pkg/data_source"
+)
+
+// Reading is a single carbon-intensity reading that a reader sends to the main thread for publishing.
+type Reading struct {
+	Key       string    // The key the reading is published under.
+	Payload   string    // The JSON message to publish.
+	Zone      string    // The zone that was requested from the data source.
+	Datetime  string    // The time the reading applies to, as reported by the data source.
+	FetchTime time.Time // The time the reading was retrieved from the data source.
+	Source    string    // The name of the data source that produced the reading.
+}
+
+// newReading converts the details returned by a data source into a Reading.
+func newReading(zone string, details data_source.DataSourceDetails, fetchTime time.Time) Reading {
+	return Reading{
+		Key:       details.Key,
+		Payload:   details.ProviderResp,
+		Zone:      zone,
+		Datetime:  details.Datetime,
+		FetchTime: fetchTime,
+		Source:    details.Source,
+	}
+}
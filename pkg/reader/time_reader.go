@@ -15,18 +15,37 @@
 package reader
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"time"
 
+	"os-climate.org/carbon-intensity/pkg/checkpoint"
+	"os-climate.org/carbon-intensity/pkg/config"
 	"os-climate.org/carbon-intensity/pkg/data_source"
 )
 
+// Configuration item that holds the number of seconds between each poll of the data provider.
+const timeDelayConfigItem = "time-reader-interval"
+
+// Poll interval, in seconds, used if the configuration file does not specify one.
+const defaultTimeDelay = "3600"
+
+// ConfigItems returns the configuration items used by the readers.
+func ConfigItems() []config.Item {
+	return []config.Item{
+		{Key: timeDelayConfigItem, Kind: config.KindInt, Default: defaultTimeDelay, Check: config.AtLeast(1)},
+	}
+}
+
 // TimeReader is am implementaiton of the IMarketReadethis. This implementation time-based reader of the market data.
 // The TimeReader will request the market data from the IDataSource object every "n" seconds where n is defined
 // as a configurable item.
 type TimerReader struct {
 	dataProvider data_source.IDataSource
-	commsChannel chan string
+	checkpoints  checkpoint.ICheckpointStore
+	commsChannel chan Reading
+	doneChannel  chan error
 	quitChannel  chan int
 	timeDelay    int
 }
@@ -35,10 +54,13 @@ type TimerReader struct {
 // Used to initialise the inter-process communication channels.
 // This may not be required if the esign calls for all GetCarbonIntensity to be used as a go routine.
 // In which case the channel initialisers move into the base class.
-func (this *TimerReader) Initialise(c chan string, quit chan int) {
+func (this *TimerReader) Initialise(c chan Reading, done chan error, quit chan int) {
 	this.commsChannel = c
+	this.doneChannel = done
 	this.quitChannel = quit
-	this.timeDelay = 120 // TODO: Replace this with a value read from the config file.
+
+	this.timeDelay = config.App().Int(timeDelayConfigItem)
+	log.Printf("TimerReader polling every %d seconds", this.timeDelay)
 }
 
 // SetDataProvider initialises the specific Market Provider that the market data will be rettirved from.
@@ -46,46 +68,142 @@ func (this *TimerReader) SetDataProvider(dp data_source.IDataSource) {
 	this.dataProvider = dp
 }
 
-// GetCarbonIntensity implements the base class function. It uses a Go routine that retrieves pricing on
-// scheduled intervals and puts the result on a channel for the main thread to pick up.
-func (this *TimerReader) GetCarbonIntensity(countries []string) {
+// SetCheckpointStore assigns the store used to skip readings that have already been published.
+func (this *TimerReader) SetCheckpointStore(store checkpoint.ICheckpointStore) {
+	this.checkpoints = store
+}
+
+// GetCarbonIntensity implements the base class function. It uses a Go routine that retrieves the carbon intensity on
+// scheduled intervals and puts the result on a channel for the main thread to pick up. It runs until a quit
+// signal is received, at which point it tells the main thread it is done.
+func (this *TimerReader) GetCarbonIntensity(ctx context.Context, countries []string) {
 	fmt.Println("GetCarbonIntensity() request for TimerReader")
 
-	if this.commsChannel == nil || this.quitChannel == nil {
+	if this.commsChannel == nil || this.doneChannel == nil || this.quitChannel == nil {
 		fmt.Println("ERROR: TimeReader::GetCarbonIntensity(): Channels not initialised.")
+		// Tell the main thread, if it can be told, so it does not wait for readings that will never come.
+		if this.doneChannel != nil {
+			this.doneChannel <- fmt.Errorf("TimerReader: Channels not initialised")
+		}
+		return
 	} else if this.dataProvider == nil {
 		fmt.Println("ERROR: TimeReader::GetCarbonIntensity(): DataProvider not initialised.")
-	} else {
-		this.GetCarbonIntensityFromProvider(countries) // Run it immediately before waiting for timethis.
-		ticker := time.NewTicker(time.Duration(this.timeDelay) * time.Second)
-		for _ = range ticker.C {
-			// Timer has fired. Iterate through each currency and get the FX pricing.
-			this.GetCarbonIntensityFromProvider(countries)
+		this.doneChannel <- fmt.Errorf("TimerReader: DataProvider not initialised")
+		return
+	}
+
+	// Run it immediately before waiting for the timer. Zones that were fetched less than an interval ago, e.g. by
+	// the run before a restart, wait for the first tick.
+	if err := this.pollZones(ctx, this.dueZones(countries)); err != nil {
+		this.stop(err)
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(this.timeDelay) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Timer has fired. Iterate through each zone and get the carbon intensity.
+			if err := this.pollZones(ctx, countries); err != nil {
+				this.stop(err)
+				return
+			}
+		case <-this.quitChannel:
+			log.Printf("TimerReader: Received a quit signal. Stopping.")
+			this.doneChannel <- nil
+			return
+		case <-ctx.Done():
+			log.Printf("TimerReader: Context cancelled. Stopping.")
+			this.doneChannel <- nil
+			return
+		}
+	}
+}
+
+// stop tells the main thread the reader has finished. A quit signal is a normal way to finish.
+func (this *TimerReader) stop(err error) {
+	if err == errQuit {
+		err = nil
+	}
+
+	this.doneChannel <- err
+}
+
+// dueZones returns the zones that have not been fetched successfully within the poll interval.
+func (this *TimerReader) dueZones(countries []string) []string {
+	interval := time.Duration(this.timeDelay) * time.Second
+
+	var due []string
+	for _, country := range countries {
+		if fetchTime, ok := lastFetch(this.checkpoints, country); ok && time.Since(fetchTime) < interval {
+			log.Printf("Skipping %s until the next poll: fetched at %s", country, fetchTime.Format(time.RFC3339))
+			continue
 		}
-		fmt.Printf("ERROR: GetCarbonIntensity() exiting the thread incorrectly")
+		due = append(due, country)
+	}
+
+	return due
+}
+
+// pollZones runs one pass over the zones. An exhausted quota only ends the current pass because the
+// quota will have been reset by a later tick. Any other error is returned so the reader stops.
+func (this *TimerReader) pollZones(ctx context.Context, countries []string) error {
+	err := this.GetCarbonIntensityFromProvider(ctx, countries)
+	if data_source.IsQuotaExhausted(err) {
+		log.Printf("WARNING: TimerReader: %v. Waiting for the next poll.", err)
+		return nil
 	}
+
+	return err
 }
 
-// getPricingFromMarketProvider calls the specific IMarketDataProvbider and processes the responses.
-func (this *TimerReader) GetCarbonIntensityFromProvider(countries []string) {
+// GetCarbonIntensityFromProvider calls the IDataSource for each zone and sends the readings to the main thread.
+// A zone that fails is skipped. Returns an error if the data source cannot be used for any zone, or errQuit if
+// a quit signal was received part way through, so the caller can stop polling.
+func (this *TimerReader) GetCarbonIntensityFromProvider(ctx context.Context, countries []string) error {
 	fmt.Println("GetCarbonIntensityFromProvider() request for TimerReader")
-	// for _, country := range countries {
-	// resp := this.dataProvider.GetCarbonIntensity(country)
-
-	// // Iterate over the list of returned market prices and send each to the channel for processing in the main thread..
-	// for _, v := range resp {
-	// 	priceData := v.Fx_key + "," + v.Provider_resp // Comma-separated header
-
-	// 	select {
-	// 	case this.commsChannel <- priceData: // Send the pricing info to the main loop via the pricing channel.
-	// 		continue
-	// 	case <-this.quitChannel: // Check if a quit signal has been received. If so, tell the main loop that all thread-termination steps are done..
-	// 		fmt.Printf("Received QUIT signal.\n")
-	// 		this.commsChannel <- "done"
-	// 		return
-	// 	}
-	// }
-
-	// TODO: Update the lastGetTimestamp with now and persist it.
-	// }
+
+	for _, country := range countries {
+		// Check for a quit signal between zones so shutdown does not wait for a full pass.
+		select {
+		case <-this.quitChannel:
+			log.Printf("TimerReader: Received a quit signal. Stopping.")
+			return errQuit
+		case <-ctx.Done():
+			return errQuit
+		default:
+		}
+
+		resp, fetched, err := fetchZone(ctx, this.dataProvider, country)
+		if err != nil {
+			return err
+		}
+		if !fetched {
+			continue
+		}
+		fetchTime := time.Now().UTC()
+		recordFetch(this.checkpoints, country, fetchTime)
+
+		// Iterate over the list of returned readings and send each to the channel for processing in the main thread.
+		for _, v := range resp {
+			reading := newReading(country, v, fetchTime)
+			if !isNewReading(this.checkpoints, reading) {
+				continue
+			}
+
+			select {
+			case this.commsChannel <- reading: // Send the reading to the main loop via the comms channel.
+				continue
+			case <-this.quitChannel: // Check if a quit signal has been received.
+				log.Printf("TimerReader: Received a quit signal. Stopping.")
+				return errQuit
+			case <-ctx.Done():
+				return errQuit
+			}
+		}
+	}
+
+	return nil
 }
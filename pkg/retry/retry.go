@@ -0,0 +1,56 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry has the backoff shared by everything that retries HTTP requests: the data sources' web-service
+// client and the webhook publisher.
+package retry
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Backoff returns the wait before the given retry, counting from 0. The delay starts at base and doubles on each
+// retry up to max. The wait is half the delay plus a random amount up to the other half, so clients that failed
+// together do not all retry together.
+func Backoff(base time.Duration, max time.Duration, attempt int) time.Duration {
+	delay := base << uint(attempt)
+	if delay <= 0 || delay > max {
+		delay = max
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// ParseRetryAfter converts a Retry-After header, either delay-seconds or an HTTP date, to a duration.
+// Returns 0 if the header is missing or cannot be parsed.
+func ParseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
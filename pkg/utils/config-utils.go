@@ -1,41 +0,0 @@
-// Package utils provides some common utilities that are used throughout the application.
-package utils
-
-import (
-	"bufio"
-	"fmt"
-	"os"
-	"strings"
-)
-
-// ReadConfig load a name/value configuration file. Entries have the format: name=value
-func ReadConfig(configFile string) map[string]string {
-
-	m := make(map[string]string)
-
-	file, err := os.Open(configFile)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open file: %s", err)
-		os.Exit(1)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if !strings.HasPrefix(line, "#") && len(line) != 0 {
-			kv := strings.Split(line, "=")
-			parameter := strings.TrimSpace(kv[0])
-			value := strings.TrimSpace(kv[1])
-			m[parameter] = value
-		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("Failed to read file: %s", err)
-		os.Exit(1)
-	}
-
-	return m
-
-}
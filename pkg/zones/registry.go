@@ -0,0 +1,138 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zones
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// ZoneDetails are the names of a zone. The file format is the same as the electricitymap /v3/zones response.
+// A zone that is a whole country only has a zone name.
+type ZoneDetails struct {
+	CountryName string `json:"countryName,omitempty"`
+	ZoneName    string `json:"zoneName"`
+}
+
+// Country returns the name of the country the zone is in.
+func (d ZoneDetails) Country() string {
+	if d.CountryName != "" {
+		return d.CountryName
+	}
+
+	return d.ZoneName
+}
+
+// Registry holds the details of every known zone. It is loaded from the countries file and can be topped up
+// from a data source's list of zones. It is safe to share between goroutines.
+type Registry struct {
+	mutex  sync.Mutex
+	zones  map[string]ZoneDetails
+	warned map[string]bool
+}
+
+// Initialise loads the countries file named in the configuration file. A missing or invalid file is logged
+// and leaves the registry empty, so readings are still published without names.
+func (r *Registry) Initialise() {
+	countriesFile := config.App().String(countriesFileConfigItem)
+
+	r.mutex.Lock()
+	r.zones = make(map[string]ZoneDetails)
+	r.warned = make(map[string]bool)
+	r.mutex.Unlock()
+
+	if err := r.Load(countriesFile); err != nil {
+		log.Printf("WARNING: Could not load zone details: %v", err)
+		return
+	}
+	log.Printf("Loaded details of %d zones from %s", len(r.Zones()), countriesFile)
+}
+
+// Load adds the zones in a countries file to the registry, replacing any existing details.
+func (r *Registry) Load(countriesFile string) error {
+	data, err := ioutil.ReadFile(countriesFile)
+	if err != nil {
+		return err
+	}
+
+	var countries map[string]ZoneDetails
+	if err := json.Unmarshal(data, &countries); err != nil {
+		return fmt.Errorf("%s: %w", countriesFile, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for zone, details := range countries {
+		r.zones[zone] = details
+	}
+
+	return nil
+}
+
+// AddMissing adds the details of a zone if the registry does not already have them. The countries file
+// takes precedence because it can be edited to correct a name.
+func (r *Registry) AddMissing(zone string, details ZoneDetails) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.zones[zone]; !ok && details.ZoneName != "" {
+		r.zones[zone] = details
+	}
+}
+
+// Lookup returns the details of a zone and whether the registry has them.
+func (r *Registry) Lookup(zone string) (ZoneDetails, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	details, ok := r.zones[zone]
+	return details, ok
+}
+
+// Describe returns the details of a zone. If the registry does not have them a warning is logged, once per
+// zone, and empty details are returned.
+func (r *Registry) Describe(zone string) ZoneDetails {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	details, ok := r.zones[zone]
+	if !ok && !r.warned[zone] {
+		log.Printf("WARNING: Zone %s is not in the zone registry. Its country and zone names will be empty.", zone)
+		r.warned[zone] = true
+	}
+
+	return details
+}
+
+// Zones returns the sorted keys of every zone in the registry.
+func (r *Registry) Zones() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]string, 0, len(r.zones))
+	for k := range r.zones {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
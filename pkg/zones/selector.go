@@ -0,0 +1,178 @@
+// Copyright 2022 Bryon Baker
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package zones decides which zones the service reads and provides details about each zone.
+package zones
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"os-climate.org/carbon-intensity/pkg/config"
+)
+
+// Configuration items for selecting zones.
+const (
+	zoneListSourceConfigItem = "zone-list-source" // Where the list of zones comes from. See the ZoneListSource* values.
+	zoneListConfigItem       = "zone-list"        // Comma-separated zones used when the source is "config".
+	zoneFilterConfigItem     = "zone-filter"      // Comma-separated glob patterns. Patterns starting with ! exclude zones.
+	countriesFileConfigItem  = "countries-file"   // The zone details file loaded into the Registry.
+)
+
+// The places the list of zones can come from.
+const (
+	ZoneListSourceAPI           = "api"            // All the zones the data source supports.
+	ZoneListSourceConfig        = "config"         // The zones listed in the zone-list configuration item.
+	ZoneListSourceCountriesFile = "countries-file" // The zones in the countries file, as loaded into the Registry.
+)
+
+// DefaultCountriesFile is the location of the zone details file if the configuration does not set one.
+const DefaultCountriesFile = "./config/countries.json"
+
+// ConfigItems returns the configuration items used to select zones and load their details.
+func ConfigItems() []config.Item {
+	return []config.Item{
+		{Key: zoneListSourceConfigItem, Kind: config.KindString, Default: ZoneListSourceAPI,
+			Options: []string{ZoneListSourceAPI, ZoneListSourceConfig, ZoneListSourceCountriesFile}},
+		{Key: zoneListConfigItem, Kind: config.KindList, RequiredIf: config.When(zoneListSourceConfigItem, ZoneListSourceConfig)},
+		{Key: zoneFilterConfigItem, Kind: config.KindList, Check: func(value string) error {
+			_, _, err := parseFilter(config.SplitList(value))
+			return err
+		}},
+		{Key: countriesFileConfigItem, Kind: config.KindString, Default: DefaultCountriesFile},
+	}
+}
+
+// IZoneLister is the part of a data source the Selector uses. data_source.IDataSource implements it.
+type IZoneLister interface {
+	GetAvailableZones(ctx context.Context) ([]string, error)
+}
+
+// Selector chooses the zones a deployment reads. It takes a list of zones from the data source, the configuration
+// file or the countries file, then applies include and exclude patterns so different deployments can cover
+// different regions.
+type Selector struct {
+	source   string
+	zoneList []string
+	registry *Registry
+	includes []string
+	excludes []string
+}
+
+// Initialise reads the zone selection from the configuration file. It must be the first method called.
+func (s *Selector) Initialise() {
+	s.source = config.App().String(zoneListSourceConfigItem)
+	s.zoneList = config.App().List(zoneListConfigItem)
+
+	var err error
+	s.includes, s.excludes, err = parseFilter(config.App().List(zoneFilterConfigItem))
+	if err != nil {
+		log.Fatalf("Selector::Initialise(): %v", err)
+	}
+
+	log.Printf("Zone selection: source=%s includes=%v excludes=%v", s.source, s.includes, s.excludes)
+}
+
+// SetZoneRegistry assigns the registry that provides the zones when the source is "countries-file".
+func (s *Selector) SetZoneRegistry(registry *Registry) {
+	s.registry = registry
+}
+
+// SelectZones returns the sorted list of zones to read.
+func (s *Selector) SelectZones(ctx context.Context, provider IZoneLister) ([]string, error) {
+	var candidates []string
+	var err error
+
+	switch s.source {
+	case ZoneListSourceAPI:
+		candidates, err = provider.GetAvailableZones(ctx)
+	case ZoneListSourceConfig:
+		candidates = s.zoneList
+	case ZoneListSourceCountriesFile:
+		if s.registry == nil {
+			return nil, fmt.Errorf("%s is %s but there is no zone registry", zoneListSourceConfigItem, s.source)
+		}
+		candidates = s.registry.Zones()
+	default:
+		err = fmt.Errorf("unknown %s (%s). Options are: %s %s %s", zoneListSourceConfigItem, s.source,
+			ZoneListSourceAPI, ZoneListSourceConfig, ZoneListSourceCountriesFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	selected := s.Filter(candidates)
+	log.Printf("Selected %d of %d zones from %s", len(selected), len(candidates), s.source)
+
+	return selected, nil
+}
+
+// Filter returns the sorted, de-duplicated zones that match an include pattern (or all zones if there are
+// no include patterns) and do not match an exclude pattern.
+func (s *Selector) Filter(candidates []string) []string {
+	seen := make(map[string]bool)
+	var selected []string
+
+	for _, zone := range candidates {
+		if seen[zone] {
+			continue
+		}
+		seen[zone] = true
+
+		if (len(s.includes) == 0 || matchAny(s.includes, zone)) && !matchAny(s.excludes, zone) {
+			selected = append(selected, zone)
+		}
+	}
+
+	sort.Strings(selected)
+	return selected
+}
+
+// matchAny returns true if the zone matches any of the patterns. The patterns have been validated so
+// path.Match cannot fail.
+func matchAny(patterns []string, zone string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, zone); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseFilter splits the zone filter into include and exclude patterns. Patterns starting with ! exclude zones.
+// Returns an error if a pattern is not a valid glob.
+func parseFilter(patterns []string) (includes []string, excludes []string, err error) {
+	for _, pattern := range patterns {
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		// Match the pattern against a dummy value to check the pattern is valid.
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s pattern (%s): %v", zoneFilterConfigItem, pattern, err)
+		}
+
+		if exclude {
+			excludes = append(excludes, pattern)
+		} else {
+			includes = append(includes, pattern)
+		}
+	}
+
+	return includes, excludes, nil
+}